@@ -61,6 +61,38 @@ func AggregateHashUnpack(data []byte) (AggregateHashData, error) {
 	return header, err
 }
 
+func AggregateHashPack(data AggregateHashData) []byte {
+	// the same layout the lua script packs, '<Iddd'
+	b := &bytes.Buffer{}
+	binary.Write(b, binary.LittleEndian, data)
+	return b.Bytes()
+}
+
+func (data AggregateHashData) Merge(other AggregateHashData) AggregateHashData {
+	// combine two aggregates as if every value had been written to one
+	// an empty aggregate has no min or max to compare
+	if data.Count == 0 {
+		return other
+	}
+	if other.Count == 0 {
+		return data
+	}
+
+	merged := AggregateHashData{
+		Count: data.Count + other.Count,
+		Sum:   data.Sum + other.Sum,
+		Min:   data.Min,
+		Max:   data.Max,
+	}
+	if other.Min < merged.Min {
+		merged.Min = other.Min
+	}
+	if other.Max > merged.Max {
+		merged.Max = other.Max
+	}
+	return merged
+}
+
 func AggregateHashPick(data AggregateHashData, fn MetricFn) float64 {
 	switch fn {
 	case CountFn:
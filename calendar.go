@@ -0,0 +1,134 @@
+package tophat
+
+import (
+	"errors"
+	"time"
+)
+
+// a Calendar replaces the built in period arithmetic of a timestep, for fiscal
+// or custom-epoch periods. times are passed in the timestep's location
+type Calendar interface {
+	// start of the period ts falls in
+	StartOfPeriod(ts time.Time) time.Time
+	// start of the periods either side of the one starting at start
+	PreviousPeriod(start time.Time) time.Time
+	NextPeriod(start time.Time) time.Time
+	// the step index of ts within its period, used as the hash key
+	PeriodStep(ts time.Time) int
+	// the time a step index starts at, the inverse of PeriodStep
+	StepTime(start time.Time, offset int) time.Time
+}
+
+// fiscal years starting on the first of a month, stepped by month
+// step offsets start at 1 like the Year period, 1 is the first fiscal month
+type FiscalYearCalendar struct {
+	StartMonth time.Month
+}
+
+func (c FiscalYearCalendar) validate() error {
+	if c.StartMonth < time.January || c.StartMonth > time.December {
+		return errors.New("Fiscal year calendar needs a start month from 1 to 12.")
+	}
+	return nil
+}
+
+func (c FiscalYearCalendar) StartOfPeriod(ts time.Time) time.Time {
+	year := ts.Year()
+	if ts.Month() < c.StartMonth {
+		year--
+	}
+	return time.Date(year, c.StartMonth, 1, 0, 0, 0, 0, ts.Location())
+}
+
+func (c FiscalYearCalendar) PreviousPeriod(start time.Time) time.Time {
+	return start.AddDate(-1, 0, 0)
+}
+
+func (c FiscalYearCalendar) NextPeriod(start time.Time) time.Time {
+	return start.AddDate(1, 0, 0)
+}
+
+func (c FiscalYearCalendar) PeriodStep(ts time.Time) int {
+	return (int(ts.Month())-int(c.StartMonth)+12)%12 + 1
+}
+
+func (c FiscalYearCalendar) StepTime(start time.Time, offset int) time.Time {
+	return start.AddDate(0, offset-1, 0)
+}
+
+// periods of whole weeks repeating a pattern from an epoch, stepped by day
+// e.g. Weeks 4,4,5 from the first day of a fiscal year gives 4-4-5 fiscal months
+// step offsets start at 0 like the Week period
+type WeekPatternCalendar struct {
+	Epoch time.Time // the date the first pattern starts, only the date is used
+	Weeks []int     // weeks in each period, repeated
+}
+
+func NewFiscal445Calendar(epoch time.Time) WeekPatternCalendar {
+	return WeekPatternCalendar{Epoch: epoch, Weeks: []int{4, 4, 5}}
+}
+
+func (c WeekPatternCalendar) validate() error {
+	if len(c.Weeks) == 0 {
+		return errors.New("Week pattern calendar needs at least one period.")
+	}
+	for _, w := range c.Weeks {
+		if w <= 0 {
+			return errors.New("Week pattern calendar periods need at least one week.")
+		}
+	}
+	return nil
+}
+
+func (c WeekPatternCalendar) locate(ts time.Time) (start time.Time, length int, step int) {
+	// find the period ts falls in by counting days from the epoch
+	// floor division keeps times before the epoch on the same pattern
+	epoch := time.Date(c.Epoch.Year(), c.Epoch.Month(), c.Epoch.Day(), 0, 0, 0, 0, ts.Location())
+
+	cycle := 0
+	for _, w := range c.Weeks {
+		cycle += w * 7
+	}
+
+	days := calendar_days(epoch, ts)
+	cycles := days / cycle
+	if days%cycle < 0 {
+		cycles--
+	}
+	rem := days - cycles*cycle
+
+	offset := cycles * cycle
+	for _, w := range c.Weeks {
+		if rem < w*7 {
+			return epoch.AddDate(0, 0, offset), w * 7, rem
+		}
+		rem -= w * 7
+		offset += w * 7
+	}
+
+	// unreachable, rem is always inside the cycle
+	return epoch.AddDate(0, 0, offset), 0, rem
+}
+
+func (c WeekPatternCalendar) StartOfPeriod(ts time.Time) time.Time {
+	start, _, _ := c.locate(ts)
+	return start
+}
+
+func (c WeekPatternCalendar) PreviousPeriod(start time.Time) time.Time {
+	return c.StartOfPeriod(start.AddDate(0, 0, -1))
+}
+
+func (c WeekPatternCalendar) NextPeriod(start time.Time) time.Time {
+	start, length, _ := c.locate(start)
+	return start.AddDate(0, 0, length)
+}
+
+func (c WeekPatternCalendar) PeriodStep(ts time.Time) int {
+	_, _, step := c.locate(ts)
+	return step
+}
+
+func (c WeekPatternCalendar) StepTime(start time.Time, offset int) time.Time {
+	return start.AddDate(0, 0, offset)
+}
@@ -0,0 +1,84 @@
+package tophat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCalendarSteps(t *testing.T) {
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+
+	// fiscal years from july, and 4-4-5 periods from monday 2024-07-01
+	fiscal := &Timestep{Name: "fy", Key: "fy", Period: Year, Keep: 2, NumSteps: 12, Calendar: FiscalYearCalendar{StartMonth: time.July}}
+	weeks := &Timestep{Name: "445", Key: "445", Period: Month, Keep: 2, NumSteps: 35, Calendar: NewFiscal445Calendar(day(2024, time.July, 1))}
+
+	tests := []struct {
+		step   *Timestep
+		ts     time.Time
+		period time.Time
+		index  int
+		start  time.Time // the start of the step
+		end    time.Time // the start of the next period
+	}{
+		{fiscal, day(2024, time.June, 15), day(2023, time.July, 1), 12, day(2024, time.June, 1), day(2024, time.July, 1)},
+		{fiscal, day(2024, time.July, 1), day(2024, time.July, 1), 1, day(2024, time.July, 1), day(2025, time.July, 1)},
+		{fiscal, day(2024, time.December, 31), day(2024, time.July, 1), 6, day(2024, time.December, 1), day(2025, time.July, 1)},
+		{fiscal, day(2025, time.January, 10), day(2024, time.July, 1), 7, day(2025, time.January, 1), day(2025, time.July, 1)},
+
+		// 4, 4 then 5 weeks, days before the epoch follow the same pattern back
+		{weeks, day(2024, time.July, 1), day(2024, time.July, 1), 0, day(2024, time.July, 1), day(2024, time.July, 29)},
+		{weeks, day(2024, time.July, 28), day(2024, time.July, 1), 27, day(2024, time.July, 28), day(2024, time.July, 29)},
+		{weeks, day(2024, time.July, 29), day(2024, time.July, 29), 0, day(2024, time.July, 29), day(2024, time.August, 26)},
+		{weeks, day(2024, time.September, 29), day(2024, time.August, 26), 34, day(2024, time.September, 29), day(2024, time.September, 30)},
+		{weeks, day(2024, time.September, 30), day(2024, time.September, 30), 0, day(2024, time.September, 30), day(2024, time.October, 28)},
+		{weeks, day(2024, time.June, 30), day(2024, time.May, 27), 34, day(2024, time.June, 30), day(2024, time.July, 1)},
+	}
+
+	for _, tt := range tests {
+		period := tt.step.StartOfPeriod(tt.ts)
+		if period != tt.period.Unix() {
+			t.Errorf("%s %s: period starts %s, want %s", tt.step.Name, tt.ts, time.Unix(period, 0).UTC(), tt.period)
+		}
+		if index := tt.step.PeriodStep(tt.ts); index != tt.index {
+			t.Errorf("%s %s: step %d, want %d", tt.step.Name, tt.ts, index, tt.index)
+		}
+		if start := tt.step.remake_timestamp(period, tt.index); start != tt.start.Unix() {
+			t.Errorf("%s %s: step starts %s, want %s", tt.step.Name, tt.ts, time.Unix(start, 0).UTC(), tt.start)
+		}
+		if end := tt.step.end_of_period(period); end != tt.end.Unix() {
+			t.Errorf("%s %s: period ends %s, want %s", tt.step.Name, tt.ts, time.Unix(end, 0).UTC(), tt.end)
+		}
+	}
+}
+
+func TestCalendarValidation(t *testing.T) {
+	c, err := NewMemoryClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		calendar Calendar
+		err      string
+	}{
+		{FiscalYearCalendar{StartMonth: time.April}, ""},
+		{FiscalYearCalendar{}, "Fiscal year calendar needs a start month from 1 to 12."},
+		{FiscalYearCalendar{StartMonth: 13}, "Fiscal year calendar needs a start month from 1 to 12."},
+		{WeekPatternCalendar{Epoch: time.Now(), Weeks: []int{4, 4, 5}}, ""},
+		{WeekPatternCalendar{Epoch: time.Now()}, "Week pattern calendar needs at least one period."},
+		{WeekPatternCalendar{Epoch: time.Now(), Weeks: []int{4, 0, 5}}, "Week pattern calendar periods need at least one week."},
+	}
+
+	for i, tt := range tests {
+		err := c.AddTimestep(&Timestep{Name: "cal" + string(rune('a'+i)), Key: "c", Period: Year, Keep: 2, NumSteps: 12, Calendar: tt.calendar})
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%+v: %v", tt.calendar, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%+v: got error %v, want %q", tt.calendar, err, tt.err)
+		}
+	}
+}
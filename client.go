@@ -2,14 +2,24 @@ package tophat
 
 import (
 	"errors"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
 
 type Client struct {
-	pool    *redis.Pool
+	stores  []Storage // shards, series are spread over them by ring
+	ring    hash_ring
+	clock   Clock
 	steps   map[string]*Timestep
 	metrics map[string]*Metric
+	derived map[string]*DerivedMetric
+
+	// per metric name, for tag rules
+	counters    map[string]*TagCounters
+	series_seen map[string]*series_cache
 }
 
 func (c *Client) AddTimestep(t *Timestep) error {
@@ -20,6 +30,19 @@ func (c *Client) AddTimestep(t *Timestep) error {
 		}
 	}
 
+	// custom widths are stored as whole seconds from the period start
+	if t.StepWidth < 0 || t.StepWidth%time.Second != 0 {
+		return errors.New("Timestep width must be a whole number of seconds.")
+	}
+
+	if v, ok := t.Calendar.(interface {
+		validate() error
+	}); ok {
+		if err := v.validate(); err != nil {
+			return err
+		}
+	}
+
 	// add to available steps
 	c.steps[t.Name] = t
 	return nil
@@ -32,6 +55,9 @@ func (c *Client) AddMetric(m *Metric) error {
 			return errors.New("Metric name already exists.")
 		}
 	}
+	if _, exists := c.derived[m.Name]; exists {
+		return errors.New("Metric name already exists.")
+	}
 
 	if len(m.Steps) == 0 {
 		return errors.New("No timesteps given.")
@@ -42,76 +68,144 @@ func (c *Client) AddMetric(m *Metric) error {
 		if _, exists := c.steps[v.Name]; !exists {
 			return errors.New("Step name not loaded, load it before adding metrics. (" + v.Name + ")")
 		}
+		if v.high_resolution() && !m.HighResolution {
+			return errors.New("Metric must set HighResolution to use per-second timesteps. (" + v.Name + ")")
+		}
+	}
+
+	// retention overrides have to be for the metric's timesteps
+	for name, keep := range m.Keep {
+		found := false
+		for _, v := range m.Steps {
+			if v.Name == name {
+				found = true
+			}
+		}
+		if !found {
+			return errors.New("Retention override for a timestep the metric doesn't use. (" + name + ")")
+		}
+		if keep < 1 {
+			return errors.New("Retention override must keep at least 1 period. (" + name + ")")
+		}
+	}
+
+	// rollups merge each timestep into the next so they have to get coarser
+	if m.Rollup {
+		for i := 1; i < len(m.Steps); i++ {
+			prev, step := m.Steps[i-1], m.Steps[i]
+			if prev.Calendar == nil && step.Calendar == nil && time_order[prev.Period] > time_order[step.Period] {
+				return errors.New("Rollup metrics need their timesteps ordered finest first. (" + step.Name + ")")
+			}
+
+			// coarse steps are rebuilt from the fine periods under them, the last time once
+			// the step's last fine period has finished, and a new one counts towards Keep
+			keep := m.keep(prev)
+			if n := rollup_span(prev, step, keep); n >= keep {
+				n = rollup_span(prev, step, 1<<20)
+				return errors.New("Rollup metrics have to keep every period of a timestep under a step of the next, " +
+					prev.Name + " needs to keep " + strconv.Itoa(n+1) + " periods for " + step.Name + ".")
+			}
+		}
+	}
+
+	// a series' keys have to share a slot for scripts and pipelines to work on a cluster
+	for _, s := range c.stores {
+		if r, ok := s.(*RedisStorage); ok && r.cluster != nil && m.Layout != ClusterKeyLayout {
+			return errors.New("Metrics on a cluster client must use ClusterKeyLayout.")
+		}
 	}
 
 	if m.Type != DefaultMetric {
 		return errors.New("Unsupported metric type.")
 	}
 
+	if m.Rules != nil {
+		if err := m.Rules.compile(m); err != nil {
+			return err
+		}
+	}
+
 	// add to available metrics
 	c.metrics[m.Name] = m
+	c.counters[m.Name] = &TagCounters{}
+	c.series_seen[m.Name] = &series_cache{}
 
 	return nil
 }
 
 func (c *Client) Write(mv MetricValue) error {
+	m, err := c.value_metric(mv)
+	if err != nil {
+		return err
+	}
+
+	// tag rules can reject the write or fold its tags
+	mv, err = c.apply_rules(m, mv)
+	if err != nil {
+		return err
+	}
+
+	// pass write off to metric with the series' shard
+	return m.WriteFloat(c.store(m, mv.TagValues), mv)
+}
+
+func (c *Client) value_metric(mv MetricValue) (*Metric, error) {
 	// find the metric by name
 	m, exists := c.metrics[mv.MetricName]
 	if !exists {
-		return errors.New("No metric with name: " + mv.MetricName)
+		return nil, errors.New("No metric with name: " + mv.MetricName)
 	}
 
 	// make sure tag lengths match
 	if len(m.Tags) != len(mv.TagValues) {
-		return errors.New("TagValues don't match the Tags count for the metric.")
+		return nil, errors.New("TagValues don't match the Tags count for the metric.")
 	}
 
-	// get a redis con
-	conn := c.pool.Get()
-	defer conn.Close()
-
-	// pass write off to metric
-	return m.WriteFloat(conn, mv)
+	return m, nil
 }
 
 func (c *Client) Graph(mgr MetricGraphRequest) (*MetricGraph, error) {
-	// find the metric by name
+	for _, offset := range mgr.Offsets {
+		if offset <= 0 {
+			return nil, errors.New("Graph offsets need to be positive, they go back in time.")
+		}
+	}
+
+	// find the metric by name, derived metrics are worked out from theirs
 	m, exists := c.metrics[mgr.MetricName]
 	if !exists {
+		if d, exists := c.derived[mgr.MetricName]; exists {
+			return c.graph_derived(d, mgr)
+		}
 		return nil, errors.New("No metric with name: " + mgr.MetricName)
 	}
 
 	// timestep needs to be in the list
-	found := false
-	for _, step := range m.Steps {
-		if mgr.Step.Name == step.Name {
-			found = true
-		}
-	}
-	if !found {
+	if !m.has_step(mgr.Step) {
 		return nil, errors.New("That timestep is not in the list for that metric.")
 	}
 
-	// get a redis con
-	conn := c.pool.Get()
-	defer conn.Close()
+	now := c.clock.Now()
+	if err := m.check_offsets(mgr.Step, mgr.Offsets, now); err != nil {
+		return nil, err
+	}
 
-	// pass graph request
-	return m.Graph(conn, mgr)
+	// pass graph request with the series' shard
+	return m.graph(c.store(m, mgr.TagValues), mgr, now)
 }
 
 func (c *Client) GraphEachTag(mgr MetricGraphRequest, tag string, tag_values []string) ([]*MetricGraph, error) {
 	// a helper function to return a multi series given a substitution list of tag values
 	// get a group by result but it doesn't go and discover the key list as it's provided
-	// find the metric by name
-	m, exists := c.metrics[mgr.MetricName]
+	// find the metric's tags by name
+	tags, exists := c.graph_tags(mgr.MetricName)
 	if !exists {
 		return nil, errors.New("No metric with name: " + mgr.MetricName)
 	}
 
 	// find the tag index
 	index := -1
-	for i, t := range m.Tags {
+	for i, t := range tags {
 		if t == tag {
 			index = i
 		}
@@ -119,7 +213,7 @@ func (c *Client) GraphEachTag(mgr MetricGraphRequest, tag string, tag_values []s
 
 	// validate we can replace tags
 	if index == -1 {
-		return nil, errors.New("Replacement tag index invalid for metric: " + m.Name)
+		return nil, errors.New("Replacement tag index invalid for metric: " + mgr.MetricName)
 	}
 
 	graphs := make([]*MetricGraph, 0, len(tag_values))
@@ -127,11 +221,14 @@ func (c *Client) GraphEachTag(mgr MetricGraphRequest, tag string, tag_values []s
 	for _, tv := range tag_values {
 		new_request := MetricGraphRequest{
 			MetricName: mgr.MetricName,
-			TagValues:  make([]string, len(m.Tags)),
+			TagValues:  make([]string, len(tags)),
 			Step:       mgr.Step,
 			Fn:         mgr.Fn,
+			Fill:       mgr.Fill,
 			FillZero:   mgr.FillZero,
 			NumSteps:   mgr.NumSteps,
+			Offsets:    mgr.Offsets,
+			Transforms: mgr.Transforms,
 		}
 		// replace the tags
 		copy(new_request.TagValues, mgr.TagValues)
@@ -148,26 +245,159 @@ func (c *Client) GraphEachTag(mgr MetricGraphRequest, tag string, tag_values []s
 	return graphs, nil
 }
 
-func NewClient(pool *redis.Pool) (*Client, error) {
+func (c *Client) TagValues(metric, tag string) ([]string, error) {
+	// discover the values written for a tag by scanning the metric's keys
+	// a derived metric has the values written to any of its metrics
+	metrics := []*Metric{}
+	if m, exists := c.metrics[metric]; exists {
+		metrics = append(metrics, m)
+	} else if d, exists := c.derived[metric]; exists {
+		metrics = d.metrics()
+	} else {
+		return nil, errors.New("No metric with name: " + metric)
+	}
+
+	seen := map[string]bool{}
+	for _, m := range metrics {
+		index := -1
+		for i, t := range m.Tags {
+			if t == tag {
+				index = i
+			}
+		}
+		if index == -1 {
+			return nil, errors.New("No tag " + tag + " for metric: " + metric)
+		}
+
+		err := c.scan_keys(filter_match(m, make([]string, len(m.Tags)), ""), func(_ Storage, key string) error {
+			if tag_values, _, _, ok := m.parse_key(key); ok {
+				seen[tag_values[index]] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	values := make([]string, 0, len(seen))
+	for v := range seen {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+
+	return values, nil
+}
+
+func (c *Client) graph_tags(name string) ([]string, bool) {
+	// the tags of anything that can be graphed by name
+	if m, exists := c.metrics[name]; exists {
+		return m.Tags, true
+	}
+	if d, exists := c.derived[name]; exists {
+		return d.Tags, true
+	}
+	return nil, false
+}
+
+func (c *Client) SetClock(clock Clock) {
+	// where graphs, imports and rollups get the current time, for tests
+	c.clock = clock
+}
+
+func (c *Client) registry() Storage {
+	// anything that isn't a series, like the schema registry, lives on the first shard
+	return c.stores[0]
+}
+
+func (c *Client) scan_keys(match string, fn func(store Storage, key string) error) error {
+	// scan every shard, fn gets the storage the key was found in
+	for _, store := range c.stores {
+		err := store.Scan(match, func(key string) error {
+			return fn(store, key)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// so listings come out in a stable order
+type timestep_list []*Timestep
+
+func (l timestep_list) Len() int      { return len(l) }
+func (l timestep_list) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l timestep_list) Less(i, j int) bool {
+	if l[i].Period != l[j].Period {
+		return time_order[l[i].Period] < time_order[l[j].Period]
+	}
+	return l[i].Name < l[j].Name
+}
+
+type metric_list []*Metric
+
+func (l metric_list) Len() int           { return len(l) }
+func (l metric_list) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l metric_list) Less(i, j int) bool { return l[i].Name < l[j].Name }
+
+func (c *Client) Timesteps() []*Timestep {
+	list := make(timestep_list, 0, len(c.steps))
+	for _, t := range c.steps {
+		list = append(list, t)
+	}
+	sort.Sort(list)
+	return list
+}
+
+func (c *Client) Metrics() []*Metric {
+	list := make(metric_list, 0, len(c.metrics))
+	for _, m := range c.metrics {
+		list = append(list, m)
+	}
+	sort.Sort(list)
+	return list
+}
+
+func NewClient(pools ...*redis.Pool) (*Client, error) {
+	// with more than one pool series are sharded between them by a consistent hash
+	// of the metric key and tag values, new pools have to be appended so existing
+	// series mostly stay where they are
+	stores := make([]Storage, 0, len(pools))
+	for _, pool := range pools {
+		stores = append(stores, NewRedisStorage(pool))
+	}
+	return NewStorageClient(stores...)
+}
+
+func NewClusterClient(cluster *Cluster) (*Client, error) {
+	// metrics added to a cluster client must use ClusterKeyLayout
+	return NewStorageClient(NewRedisClusterStorage(cluster))
+}
+
+func NewStorageClient(stores ...Storage) (*Client, error) {
+	// like NewClient for any storage, sharded the same way
+	if len(stores) == 0 {
+		return nil, errors.New("No storage given.")
+	}
 
 	client := &Client{
-		pool:    pool,
+		stores:  stores,
+		ring:    new_hash_ring(len(stores)),
+		clock:   system_clock{},
 		steps:   map[string]*Timestep{},
 		metrics: map[string]*Metric{},
+		derived: map[string]*DerivedMetric{},
+
+		counters:    map[string]*TagCounters{},
+		series_seen: map[string]*series_cache{},
 	}
 
 	// preload default steps
-	if err := client.AddTimestep(TimestepHour); err != nil {
-		return nil, err
-	}
-	if err := client.AddTimestep(TimestepDay); err != nil {
-		return nil, err
-	}
-	if err := client.AddTimestep(TimestepMonth); err != nil {
-		return nil, err
-	}
-	if err := client.AddTimestep(TimestepYear); err != nil {
-		return nil, err
+	for _, t := range BuiltinTimesteps {
+		if err := client.AddTimestep(t); err != nil {
+			return nil, err
+		}
 	}
 
 	return client, nil
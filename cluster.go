@@ -0,0 +1,420 @@
+package tophat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// number of hash slots a redis cluster splits keys into
+const cluster_slots = 16384
+
+// how many MOVED/ASK redirects a command follows before giving up
+const cluster_redirects = 5
+
+// a Cluster routes commands to the master serving each key's slot
+// metrics used with it need ClusterKeyLayout so a series' keys share a slot
+type Cluster struct {
+	new_pool func(addr string) *redis.Pool
+
+	mu    sync.RWMutex
+	slots [cluster_slots]string // slot => master address
+	pools map[string]*redis.Pool
+}
+
+func NewCluster(addrs []string, new_pool func(addr string) *redis.Pool) (*Cluster, error) {
+	// addrs are host:port seeds, the slot map is read from the first that answers
+	// new_pool builds the pool used for each node
+	c := &Cluster{
+		new_pool: new_pool,
+		pools:    map[string]*redis.Pool{},
+	}
+
+	err := errors.New("No cluster addresses given.")
+	for _, addr := range addrs {
+		if err = c.refresh(addr); err == nil {
+			return c, nil
+		}
+	}
+	return nil, err
+}
+
+func (c *Cluster) Get() redis.Conn {
+	// a connection that sends each command to the node for its key
+	return &cluster_conn{cluster: c, conns: map[string]redis.Conn{}}
+}
+
+func (c *Cluster) node(addr string) *redis.Pool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, exists := c.pools[addr]
+	if !exists {
+		p = c.new_pool(addr)
+		c.pools[addr] = p
+	}
+	return p
+}
+
+func (c *Cluster) refresh(addr string) error {
+	// reload the slot map from a node with cluster slots
+	// each entry is start, end, master [host, port, ...], replicas...
+	conn := c.node(addr).Get()
+	defer conn.Close()
+
+	entries, err := redis.Values(conn.Do("cluster", "slots"))
+	if err != nil {
+		return errors.New("Failed reading cluster slots from " + addr + " " + err.Error())
+	}
+
+	slots := [cluster_slots]string{}
+	for _, e := range entries {
+		entry, err := redis.Values(e, nil)
+		if err != nil || len(entry) < 3 {
+			return errors.New("Unexpected cluster slots reply from " + addr)
+		}
+		start, err := redis.Int(entry[0], nil)
+		if err != nil {
+			return err
+		}
+		end, err := redis.Int(entry[1], nil)
+		if err != nil {
+			return err
+		}
+		master, err := redis.Values(entry[2], nil)
+		if err != nil || len(master) < 2 {
+			return errors.New("Unexpected cluster slots reply from " + addr)
+		}
+		host, err := redis.String(master[0], nil)
+		if err != nil {
+			return err
+		}
+		port, err := redis.Int(master[1], nil)
+		if err != nil {
+			return err
+		}
+
+		// a node can leave its own host blank
+		node := addr
+		if host != "" {
+			node = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		for slot := start; slot <= end && slot < cluster_slots; slot++ {
+			slots[slot] = node
+		}
+	}
+
+	c.mu.Lock()
+	c.slots = slots
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Cluster) addr(slot int) (string, error) {
+	c.mu.RLock()
+	addr := c.slots[slot]
+	c.mu.RUnlock()
+	if addr != "" {
+		return addr, nil
+	}
+
+	// nobody had the slot last time, the map may be stale
+	for _, m := range c.masters() {
+		if err := c.refresh(m); err == nil {
+			break
+		}
+	}
+
+	c.mu.RLock()
+	addr = c.slots[slot]
+	c.mu.RUnlock()
+	if addr == "" {
+		return "", errors.New("No cluster node serves slot " + strconv.Itoa(slot))
+	}
+	return addr, nil
+}
+
+func (c *Cluster) moved(slot int, addr string) {
+	c.mu.Lock()
+	c.slots[slot] = addr
+	c.mu.Unlock()
+}
+
+func (c *Cluster) masters() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	seen := map[string]bool{}
+	addrs := []string{}
+	for _, addr := range c.slots {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func key_slot(key string) int {
+	// only the part inside the first {} is hashed if there is one
+	if s := strings.Index(key, "{"); s != -1 {
+		if e := strings.Index(key[s+1:], "}"); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+	return int(crc16(key)) % cluster_slots
+}
+
+func crc16(s string) uint16 {
+	// crc16-ccitt (xmodem), what redis cluster hashes keys with
+	crc := uint16(0)
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for b := 0; b < 8; b++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func command_key(cmd string, args []interface{}) (string, bool) {
+	// the key a command is routed by, scripts by their first key
+	switch strings.ToLower(cmd) {
+	case "eval", "evalsha":
+		if len(args) < 3 {
+			return "", false
+		}
+		if n, err := redis.Int(args[1], nil); err != nil || n < 1 {
+			return "", false
+		}
+		return arg_string(args[2]), true
+	case "scan", "script", "cluster", "ping", "info", "asking":
+		return "", false
+	}
+	if len(args) == 0 {
+		return "", false
+	}
+	return arg_string(args[0]), true
+}
+
+func arg_string(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return fmt.Sprint(arg)
+}
+
+func redirect(err error) (kind string, slot int, addr string, ok bool) {
+	// MOVED 3999 127.0.0.1:6381 or ASK 3999 127.0.0.1:6381
+	e, is := err.(redis.Error)
+	if !is {
+		return "", 0, "", false
+	}
+	parts := strings.Fields(string(e))
+	if len(parts) != 3 || (parts[0] != "MOVED" && parts[0] != "ASK") {
+		return "", 0, "", false
+	}
+	slot, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, "", false
+	}
+	return parts[0], slot, parts[2], true
+}
+
+// a pipelined command and the node it went to, replayed if it was redirected
+type cluster_pending struct {
+	addr string
+	cmd  string
+	args []interface{}
+}
+
+type cluster_conn struct {
+	cluster *Cluster
+	conns   map[string]redis.Conn // node connections taken from their pools
+	pending []cluster_pending
+	closed  bool
+}
+
+func (cc *cluster_conn) conn(addr string) redis.Conn {
+	conn, exists := cc.conns[addr]
+	if !exists {
+		conn = cc.cluster.node(addr).Get()
+		cc.conns[addr] = conn
+	}
+	return conn
+}
+
+func (cc *cluster_conn) route(cmd string, args []interface{}) (string, error) {
+	key, ok := command_key(cmd, args)
+	if !ok {
+		return "", errors.New("Can't route a command without a key on a cluster: " + cmd)
+	}
+	return cc.cluster.addr(key_slot(key))
+}
+
+func (cc *cluster_conn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cc.closed {
+		return nil, errors.New("Cluster connection closed.")
+	}
+
+	// flush and read anything pipelined, like redigo does
+	if cmd == "" {
+		if err := cc.Flush(); err != nil {
+			return nil, err
+		}
+		var reply interface{}
+		for len(cc.pending) > 0 {
+			r, err := cc.Receive()
+			if err != nil {
+				return nil, err
+			}
+			reply = r
+		}
+		return reply, nil
+	}
+
+	// scripts have to be loaded on every master that might run them
+	if strings.EqualFold(cmd, "script") {
+		var reply interface{}
+		for _, addr := range cc.cluster.masters() {
+			r, err := cc.do_node(addr, cmd, args, false)
+			if err != nil {
+				return nil, err
+			}
+			reply = r
+		}
+		return reply, nil
+	}
+
+	addr, err := cc.route(cmd, args)
+	if err != nil {
+		return nil, err
+	}
+	return cc.do(addr, cmd, args, false)
+}
+
+func (cc *cluster_conn) do(addr, cmd string, args []interface{}, asking bool) (interface{}, error) {
+	// follow redirects while slots are being moved between nodes
+	for i := 0; ; i++ {
+		reply, err := cc.do_node(addr, cmd, args, asking)
+		kind, slot, to, ok := redirect(err)
+		if !ok || i >= cluster_redirects {
+			return reply, err
+		}
+
+		if kind == "MOVED" {
+			cc.cluster.moved(slot, to)
+		}
+		asking = kind == "ASK"
+		addr = to
+	}
+}
+
+func (cc *cluster_conn) do_node(addr, cmd string, args []interface{}, asking bool) (interface{}, error) {
+	// Do on a connection reads every pending reply first, so while a node has
+	// pipelined commands waiting a separate connection is used
+	conn := cc.conn(addr)
+	for _, p := range cc.pending {
+		if p.addr == addr {
+			conn = cc.cluster.node(addr).Get()
+			defer conn.Close()
+			break
+		}
+	}
+
+	if asking {
+		if _, err := conn.Do("asking"); err != nil {
+			return nil, err
+		}
+	}
+	return conn.Do(cmd, args...)
+}
+
+func (cc *cluster_conn) Send(cmd string, args ...interface{}) error {
+	if cc.closed {
+		return errors.New("Cluster connection closed.")
+	}
+
+	addr, err := cc.route(cmd, args)
+	if err != nil {
+		return err
+	}
+	if err := cc.conn(addr).Send(cmd, args...); err != nil {
+		return err
+	}
+	cc.pending = append(cc.pending, cluster_pending{addr: addr, cmd: cmd, args: args})
+	return nil
+}
+
+func (cc *cluster_conn) Flush() error {
+	flushed := map[string]bool{}
+	for _, p := range cc.pending {
+		if flushed[p.addr] {
+			continue
+		}
+		if err := cc.conn(p.addr).Flush(); err != nil {
+			return err
+		}
+		flushed[p.addr] = true
+	}
+	return nil
+}
+
+func (cc *cluster_conn) Receive() (interface{}, error) {
+	// replies come back in send order per node, so take them in send order overall
+	if len(cc.pending) == 0 {
+		return nil, errors.New("Cluster connection has no pending replies.")
+	}
+	p := cc.pending[0]
+	cc.pending = cc.pending[1:]
+
+	reply, err := cc.conn(p.addr).Receive()
+	if kind, slot, to, ok := redirect(err); ok {
+		if kind == "MOVED" {
+			cc.cluster.moved(slot, to)
+		}
+		// replay the command where the cluster said it lives now
+		return cc.do(to, p.cmd, p.args, kind == "ASK")
+	}
+	return reply, err
+}
+
+func (cc *cluster_conn) Err() error {
+	for _, conn := range cc.conns {
+		if err := conn.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cc *cluster_conn) Close() error {
+	if cc.closed {
+		return nil
+	}
+	cc.closed = true
+
+	var err error
+	for _, conn := range cc.conns {
+		if e := conn.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	cc.conns = nil
+	cc.pending = nil
+	return err
+}
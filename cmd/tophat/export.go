@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+
+	"github.com/fancysupport/tophat"
+)
+
+func run_export(th *tophat.Client, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	gf := add_graph_flags(fs)
+	each := fs.String("each", "", "export a graph for every value written for this tag")
+	format := fs.String("format", "csv", "csv (wide), csv-long or ndjson")
+	fs.Parse(args)
+
+	mgr, err := gf.request(th, *each)
+	if err != nil {
+		return err
+	}
+
+	graphs := []*tophat.MetricGraph{}
+	if *each == "" {
+		g, err := th.Graph(mgr)
+		if err != nil {
+			return err
+		}
+		graphs = append(graphs, g)
+	} else {
+		values, err := th.TagValues(mgr.MetricName, *each)
+		if err != nil {
+			return err
+		}
+		if graphs, err = th.GraphEachTag(mgr, *each, values); err != nil {
+			return err
+		}
+	}
+
+	switch *format {
+	case "csv":
+		return tophat.WriteCSVWide(os.Stdout, graphs)
+	case "csv-long":
+		return tophat.WriteCSVLong(os.Stdout, graphs)
+	case "ndjson":
+		return tophat.WriteNDJSON(os.Stdout, graphs)
+	}
+
+	return errors.New("Unknown export format: " + *format)
+}
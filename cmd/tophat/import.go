@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fancysupport/tophat"
+)
+
+// rows handed to Client.Import at a time
+const import_chunk = 10000
+
+func run_import(th *tophat.Client, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	metric := fs.String("metric", "", "metric name")
+	format := fs.String("format", "csv", "csv (timestamp,tags...,value) or ndjson")
+	verbose := fs.Bool("v", false, "print every skipped row")
+	fs.Parse(args)
+
+	m, err := find_metric(th, *metric)
+	if err != nil {
+		return err
+	}
+
+	in := io.Reader(os.Stdin)
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var next func() (tophat.MetricValue, error)
+	switch *format {
+	case "csv":
+		next, err = csv_rows(m, in)
+	case "ndjson":
+		next, err = ndjson_rows(m, in)
+	default:
+		err = errors.New("Unknown import format: " + *format)
+	}
+	if err != nil {
+		return err
+	}
+
+	total := &tophat.ImportReport{}
+	row := 0
+	done := false
+
+	for !done {
+		chunk := make([]tophat.MetricValue, 0, import_chunk)
+		for len(chunk) < import_chunk {
+			mv, err := next()
+			if err == io.EOF {
+				done = true
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("row %d: %s", row+len(chunk)+1, err)
+			}
+			chunk = append(chunk, mv)
+		}
+
+		report, err := th.Import(chunk)
+		if report != nil {
+			total.Written += report.Written
+			total.StepsWritten += report.StepsWritten
+			total.StepsExpired += report.StepsExpired
+			for _, skip := range report.Skipped {
+				skip.Index += row
+				total.Skipped = append(total.Skipped, skip)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		row += len(chunk)
+	}
+
+	fmt.Printf("rows: %d written: %d skipped: %d step writes: %d expired step writes: %d\n",
+		row, total.Written, len(total.Skipped), total.StepsWritten, total.StepsExpired)
+
+	if *verbose {
+		for _, skip := range total.Skipped {
+			fmt.Printf("skipped row %d: %s\n", skip.Index+1, skip.Reason)
+		}
+	}
+
+	return nil
+}
+
+func csv_rows(m *tophat.Metric, in io.Reader) (func() (tophat.MetricValue, error), error) {
+	// the same layout the export command writes with -format csv-long
+	r := csv.NewReader(in)
+	header, err := r.Read()
+	if err != nil {
+		return nil, errors.New("Failed reading csv header: " + err.Error())
+	}
+	if len(header) != len(m.Tags)+2 || header[0] != "timestamp" || header[len(header)-1] != "value" {
+		return nil, errors.New("CSV header must be timestamp," + strings.Join(m.Tags, ",") + ",value")
+	}
+
+	// map metric tag order onto the csv columns
+	columns := make([]int, len(m.Tags))
+	for i, tag := range m.Tags {
+		columns[i] = -1
+		for c, name := range header {
+			if name == tag {
+				columns[i] = c
+			}
+		}
+		if columns[i] == -1 {
+			return nil, errors.New("CSV header is missing tag: " + tag)
+		}
+	}
+
+	return func() (tophat.MetricValue, error) {
+		record, err := r.Read()
+		if err != nil {
+			return tophat.MetricValue{}, err
+		}
+
+		ts, err := parse_time(record[0])
+		if err != nil {
+			return tophat.MetricValue{}, err
+		}
+		// a blank value is a gap in the export, Import skips NaN
+		value := math.NaN()
+		if raw := record[len(record)-1]; raw != "" {
+			if value, err = strconv.ParseFloat(raw, 64); err != nil {
+				return tophat.MetricValue{}, err
+			}
+		}
+
+		tvs := make([]string, len(columns))
+		for i, c := range columns {
+			tvs[i] = record[c]
+		}
+
+		return tophat.MetricValue{
+			MetricName: m.Name,
+			TagValues:  tvs,
+			Timestamp:  ts,
+			ValueFloat: value,
+		}, nil
+	}, nil
+}
+
+func ndjson_rows(m *tophat.Metric, in io.Reader) (func() (tophat.MetricValue, error), error) {
+	// the same layout the export command writes with -format ndjson
+	scanner := bufio.NewScanner(in)
+
+	return func() (tophat.MetricValue, error) {
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+
+			row := tophat.ExportRow{}
+			if err := json.Unmarshal([]byte(line), &row); err != nil {
+				return tophat.MetricValue{}, err
+			}
+
+			ts, err := parse_time(row.Timestamp)
+			if err != nil {
+				return tophat.MetricValue{}, err
+			}
+
+			tvs := make([]string, len(m.Tags))
+			for i, tag := range m.Tags {
+				v, exists := row.Tags[tag]
+				if !exists {
+					return tophat.MetricValue{}, errors.New("Missing value for tag: " + tag)
+				}
+				tvs[i] = v
+			}
+
+			return tophat.MetricValue{
+				MetricName: m.Name,
+				TagValues:  tvs,
+				Timestamp:  ts,
+				ValueFloat: row.Value,
+			}, nil
+		}
+
+		if err := scanner.Err(); err != nil {
+			return tophat.MetricValue{}, err
+		}
+		return tophat.MetricValue{}, io.EOF
+	}, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/fancysupport/tophat"
+)
+
+func import_client(t *testing.T, clock tophat.Clock) (*tophat.Client, *tophat.Metric) {
+	c, err := tophat.NewMemoryClient(clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &tophat.Metric{Name: "hits", Key: "hits", Tags: []string{"page"}, Steps: []*tophat.Timestep{tophat.TimestepHour}, Type: tophat.DefaultMetric}
+	if err := c.AddMetric(m); err != nil {
+		t.Fatal(err)
+	}
+	return c, m
+}
+
+func TestExportImportGaps(t *testing.T) {
+	// a NullFill export read back in skips the gaps instead of writing them as 0
+	clock := tophat.NewManualClock(time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC))
+	src, _ := import_client(t, clock)
+	for _, w := range []struct {
+		ago   time.Duration
+		value float64
+	}{{0, 3}, {0, 4}, {2 * time.Minute, 5}, {4 * time.Minute, -1}} {
+		err := src.Write(tophat.MetricValue{MetricName: "hits", TagValues: []string{"home"}, Timestamp: clock.Now().Add(-w.ago), ValueFloat: w.value})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mgr := tophat.MetricGraphRequest{MetricName: "hits", TagValues: []string{"home"}, Step: tophat.TimestepHour, Fn: tophat.SumFn, NumSteps: 6, Fill: tophat.NullFill}
+	exported, err := src.Graph(mgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	formats := []struct {
+		name  string
+		write func(w io.Writer, graphs []*tophat.MetricGraph) error
+		rows  func(m *tophat.Metric, in io.Reader) (func() (tophat.MetricValue, error), error)
+	}{
+		{"ndjson", tophat.WriteNDJSON, ndjson_rows},
+		{"csv", tophat.WriteCSVLong, csv_rows},
+	}
+
+	for _, f := range formats {
+		b := &bytes.Buffer{}
+		if err := f.write(b, []*tophat.MetricGraph{exported}); err != nil {
+			t.Fatal(err)
+		}
+
+		dst, m := import_client(t, clock)
+		next, err := f.rows(m, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := []tophat.MetricValue{}
+		for {
+			mv, err := next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", f.name, err)
+			}
+			values = append(values, mv)
+		}
+
+		report, err := dst.Import(values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(values) != 6 || report.Written != 3 || len(report.Skipped) != 3 {
+			t.Errorf("%s: read %d rows, wrote %d and skipped %d, want 6, 3 and 3", f.name, len(values), report.Written, len(report.Skipped))
+		}
+
+		// the sums come back the same, and each step has the one write of it
+		imported, err := dst.Graph(mgr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !same(imported.Values, exported.Values) {
+			t.Errorf("%s: sums came back as %v, want %v", f.name, imported.Values, exported.Values)
+		}
+
+		mgr := mgr
+		mgr.Fn = tophat.MinFn
+		min, err := dst.Graph(mgr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !same(min.Values, exported.Values) {
+			t.Errorf("%s: mins came back as %v, want %v", f.name, min.Values, exported.Values)
+		}
+	}
+}
+
+func same(a, b tophat.GraphValues) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		for j := range a[i] {
+			if a[i][j] != b[i][j] && !(math.IsNaN(a[i][j]) && math.IsNaN(b[i][j])) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fancysupport/tophat"
+)
+
+func run_key(th *tophat.Client, args []string) error {
+	fs := flag.NewFlagSet("key", flag.ExitOnError)
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return errors.New("Give one or more keys to decode.")
+	}
+
+	for _, key := range fs.Args() {
+		m, kp, err := th.ParseKey(key)
+		if err != nil {
+			return err
+		}
+
+		tags := make([]string, len(m.Tags))
+		for i, tag := range m.Tags {
+			tags[i] = tag + "=" + kp.TagValues[i]
+		}
+		fmt.Printf("%s metric=%s tags=%s start=%s step=%s\n",
+			key, m.Name, strings.Join(tags, ","), time.Unix(kp.Start, 0).UTC().Format(time.RFC3339), kp.StepKey)
+	}
+	return nil
+}
+
+func run_migrate(th *tophat.Client, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	metric := fs.String("metric", "", "metric name")
+	tag := fs.String("tag", "", "tag whose values may contain ':', extra key parts are joined into it")
+	dry_run := fs.Bool("dry-run", false, "list what would move without moving it")
+	fs.Parse(args)
+
+	m, err := find_metric(th, *metric)
+	if err != nil {
+		return err
+	}
+
+	mr := tophat.MigrateKeysRequest{MetricName: m.Name, DryRun: *dry_run}
+
+	if *tag != "" {
+		index := -1
+		for i, t := range m.Tags {
+			if t == *tag {
+				index = i
+			}
+		}
+		if index == -1 {
+			return errors.New("Metric " + m.Name + " has no tag: " + *tag)
+		}
+
+		// everything either side of the tag is one part each
+		mr.Split = func(raw []string) ([]string, bool) {
+			extra := len(raw) - len(m.Tags)
+			if extra < 0 {
+				return nil, false
+			}
+			values := append([]string{}, raw[:index]...)
+			values = append(values, strings.Join(raw[index:index+extra+1], tophat.SEP))
+			values = append(values, raw[index+extra+1:]...)
+			return values, true
+		}
+	}
+
+	report, err := th.MigrateKeys(mr)
+	if err != nil {
+		return err
+	}
+
+	verb := "moved"
+	if mr.DryRun {
+		verb = "would move"
+	}
+
+	keys := make([]string, 0, len(report.Moved))
+	for key := range report.Moved {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Println(verb, key, "to", report.Moved[key])
+	}
+	for _, key := range report.Skipped {
+		fmt.Println("skipped", key)
+	}
+
+	fmt.Printf("%s %d keys, skipped %d\n", verb, len(report.Moved), len(report.Skipped))
+	return nil
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fancysupport/tophat"
+	"github.com/garyburd/redigo/redis"
+)
+
+const usage = `usage: tophat [-redis url] [-cluster] [-schema file] <command> [args]
+
+commands:
+  write      write a value to a metric
+  graph      show a metric graph as a table, sparkline or chart
+  export     write metric graphs as csv or ndjson
+  query      graph series picked, grouped and piped by a query expression
+  import     backfill historical values from csv or ndjson
+  rollup     merge finished periods into coarser timesteps for rollup metrics
+  purge      remove data by tag values and time range
+  rename     merge the history of one tag value into another
+  migrate    move keys written before tag values were escaped
+  key        decode keys into metric, tag values, period and timestep
+  metrics    list the loaded metrics
+  timesteps  list the loaded timesteps
+  tags       list the values written for a metric tag
+  register   store the loaded schema in the registry
+
+the schema is read from -schema, or from the registry in redis if not given
+-redis takes comma separated urls to shard series between them, keep their order
+and add new shards at the end. with -cluster the -redis host is any node of a redis cluster
+`
+
+var commands = map[string]func(th *tophat.Client, args []string) error{
+	"write":     run_write,
+	"graph":     run_graph,
+	"export":    run_export,
+	"query":     run_query,
+	"import":    run_import,
+	"rollup":    run_rollup,
+	"purge":     run_purge,
+	"rename":    run_rename,
+	"migrate":   run_migrate,
+	"key":       run_key,
+	"metrics":   run_metrics,
+	"timesteps": run_timesteps,
+	"tags":      run_tags,
+	"register":  run_register,
+}
+
+func main() {
+	redis_url := flag.String("redis", "redis://localhost:6379", "redis url, redis://[:password@]host[:port][/db]")
+	cluster := flag.Bool("cluster", false, "connect to a redis cluster, metrics need the cluster key layout")
+	schema := flag.String("schema", "", "schema json file, defaults to the registry")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	run, exists := commands[flag.Arg(0)]
+	if !exists {
+		fmt.Fprintln(os.Stderr, "unknown command:", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var th *tophat.Client
+	if *cluster {
+		th, err = new_cluster_client(*redis_url)
+	} else {
+		th, err = new_client(*redis_url)
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	if err := load_schema(th, *schema); err != nil {
+		fatal(err)
+	}
+	for _, m := range th.Metrics() {
+		for _, warning := range m.Warnings() {
+			fmt.Fprintln(os.Stderr, "tophat: warning:", warning)
+		}
+	}
+
+	if err := run(th, flag.Args()[1:]); err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "tophat:", err)
+	os.Exit(1)
+}
+
+func new_client(raw string) (*tophat.Client, error) {
+	// comma separated urls are shards, in the order they were added
+	pools := []*redis.Pool{}
+	for _, u := range strings.Split(raw, ",") {
+		pool, err := new_pool(strings.TrimSpace(u))
+		if err != nil {
+			return nil, err
+		}
+		pools = append(pools, pool)
+	}
+	return tophat.NewClient(pools...)
+}
+
+func new_cluster_client(raw string) (*tophat.Client, error) {
+	// every node gets a pool from the same url with its own host
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if path := strings.Trim(u.Path, "/"); path != "" && path != "0" {
+		return nil, errors.New("Redis cluster only has database 0.")
+	}
+	seed, err := new_pool(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	cluster, err := tophat.NewCluster([]string{u.Host}, func(addr string) *redis.Pool {
+		if addr == u.Host {
+			return seed
+		}
+		node := *u
+		node.Host = addr
+		pool, _ := new_pool(node.String())
+		return pool
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tophat.NewClusterClient(cluster)
+}
+
+func new_pool(raw string) (*redis.Pool, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, errors.New("Redis url must use the redis:// scheme.")
+	}
+
+	host := u.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "6379")
+	}
+
+	password := ""
+	if u.User != nil {
+		password, _ = u.User.Password()
+		if password == "" {
+			password = u.User.Username()
+		}
+	}
+
+	db := 0
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		if db, err = strconv.Atoi(path); err != nil {
+			return nil, errors.New("Redis url database must be a number: " + path)
+		}
+	}
+
+	t := 10 * time.Second
+	return &redis.Pool{
+		MaxIdle:     5,
+		IdleTimeout: 3 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			c, err := redis.DialTimeout("tcp", host, t, t, t)
+			if err != nil {
+				return nil, err
+			}
+			if password != "" {
+				if _, err := c.Do("auth", password); err != nil {
+					c.Close()
+					return nil, err
+				}
+			}
+			if db != 0 {
+				if _, err := c.Do("select", db); err != nil {
+					c.Close()
+					return nil, err
+				}
+			}
+			return c, nil
+		},
+	}, nil
+}
+
+func load_schema(th *tophat.Client, path string) error {
+	if path == "" {
+		return th.LoadRegistry()
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s, err := tophat.ReadSchema(f)
+	if err != nil {
+		return err
+	}
+
+	return th.LoadSchema(s)
+}
+
+func find_metric(th *tophat.Client, name string) (*tophat.Metric, error) {
+	for _, m := range th.Metrics() {
+		if m.Name == name {
+			return m, nil
+		}
+	}
+	return nil, errors.New("No metric with name: " + name)
+}
+
+func find_step(th *tophat.Client, name string) (*tophat.Timestep, error) {
+	for _, t := range th.Timesteps() {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+	return nil, errors.New("No timestep with name: " + name)
+}
+
+func graph_tags(th *tophat.Client, name string) ([]string, error) {
+	// the tags of a metric or a derived metric
+	if m, err := find_metric(th, name); err == nil {
+		return m.Tags, nil
+	}
+	for _, d := range th.DerivedMetrics() {
+		if d.Name == name {
+			return d.Tags, nil
+		}
+	}
+	return nil, errors.New("No metric with name: " + name)
+}
+
+func tag_values(name string, tags []string, raw string, skip string) ([]string, error) {
+	// tags are given as tag=value,tag=value and put in the metric's order
+	// the skip tag may be left out, it gets an empty value
+	given := map[string]string{}
+	if raw != "" {
+		for _, pair := range strings.Split(raw, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return nil, errors.New("Tags must look like tag=value: " + pair)
+			}
+			given[kv[0]] = kv[1]
+		}
+	}
+
+	values := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		v, exists := given[tag]
+		if !exists && tag != skip {
+			return nil, errors.New("Missing value for tag: " + tag)
+		}
+		values = append(values, v)
+		delete(given, tag)
+	}
+
+	for tag := range given {
+		return nil, errors.New("Metric " + name + " has no tag: " + tag)
+	}
+
+	return values, nil
+}
+
+func parse_time(raw string) (time.Time, error) {
+	if raw == "" {
+		return time.Now(), nil
+	}
+	if unix, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	return time.Parse(time.RFC3339, raw)
+}
+
+func run_write(th *tophat.Client, args []string) error {
+	fs := flag.NewFlagSet("write", flag.ExitOnError)
+	metric := fs.String("metric", "", "metric name")
+	tags := fs.String("tags", "", "tag values, tag=value,tag=value")
+	at := fs.String("time", "", "timestamp, unix seconds or RFC3339, defaults to now")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("write expects a single value")
+	}
+	value, err := strconv.ParseFloat(fs.Arg(0), 64)
+	if err != nil {
+		return err
+	}
+
+	m, err := find_metric(th, *metric)
+	if err != nil {
+		return err
+	}
+	tvs, err := tag_values(m.Name, m.Tags, *tags, "")
+	if err != nil {
+		return err
+	}
+	ts, err := parse_time(*at)
+	if err != nil {
+		return err
+	}
+
+	return th.Write(tophat.MetricValue{
+		MetricName: m.Name,
+		TagValues:  tvs,
+		Timestamp:  ts,
+		ValueFloat: value,
+	})
+}
+
+type graph_flags struct {
+	metric    *string
+	tags      *string
+	step      *string
+	fn        *string
+	fill      *bool
+	fill_mode *string
+	num       *int
+	offset    *string
+	transform *string
+}
+
+func add_graph_flags(fs *flag.FlagSet) *graph_flags {
+	return &graph_flags{
+		metric:    fs.String("metric", "", "metric name"),
+		tags:      fs.String("tags", "", "tag values, tag=value,tag=value"),
+		step:      fs.String("step", "hour", "timestep name"),
+		fn:        fs.String("fn", "count", "count, sum, min, max or avg"),
+		fill:      fs.Bool("fill", false, "fill empty steps with zero"),
+		fill_mode: fs.String("fill-mode", "none", "none, zero, null, previous or linear"),
+		num:       fs.Int("n", 0, "number of steps, defaults to the timestep's"),
+		offset:    fs.String("offset", "", "also graph the window this long ago, e.g. 24h,168h, as far back as the metric keeps"),
+		transform: fs.String("transform", "", "transforms to apply in order, e.g. 'movavg(3) | rate'"),
+	}
+}
+
+func (gf *graph_flags) request(th *tophat.Client, skip string) (tophat.MetricGraphRequest, error) {
+	// build a graph request from the flags, skip is a tag that will be substituted later
+	mgr := tophat.MetricGraphRequest{
+		FillZero: *gf.fill,
+		NumSteps: *gf.num,
+	}
+
+	tags, err := graph_tags(th, *gf.metric)
+	if err != nil {
+		return mgr, err
+	}
+	mgr.MetricName = *gf.metric
+
+	if mgr.TagValues, err = tag_values(mgr.MetricName, tags, *gf.tags, skip); err != nil {
+		return mgr, err
+	}
+	if mgr.Step, err = find_step(th, *gf.step); err != nil {
+		return mgr, err
+	}
+	if mgr.Fn, err = tophat.ParseMetricFn(*gf.fn); err != nil {
+		return mgr, err
+	}
+	if mgr.Fill, err = tophat.ParseFillMode(*gf.fill_mode); err != nil {
+		return mgr, err
+	}
+	if *gf.offset != "" {
+		for _, o := range strings.Split(*gf.offset, ",") {
+			offset, err := time.ParseDuration(strings.TrimSpace(o))
+			if err != nil {
+				return mgr, errors.New("Bad offset: " + o)
+			}
+			mgr.Offsets = append(mgr.Offsets, offset)
+		}
+	}
+	if mgr.Transforms, err = tophat.ParseTransforms(*gf.transform); err != nil {
+		return mgr, err
+	}
+
+	return mgr, nil
+}
+
+func run_graph(th *tophat.Client, args []string) error {
+	fs := flag.NewFlagSet("graph", flag.ExitOnError)
+	gf := add_graph_flags(fs)
+	spark := fs.Bool("spark", false, "print a sparkline instead of a table")
+	chart := fs.Int("chart", 0, "print an ascii chart this many rows high instead of a table")
+	fs.Parse(args)
+
+	mgr, err := gf.request(th, "")
+	if err != nil {
+		return err
+	}
+
+	graph, err := th.Graph(mgr)
+	if err != nil {
+		return err
+	}
+
+	if *spark {
+		fmt.Println(graph.Sparkline())
+		return nil
+	}
+	if *chart > 0 {
+		fmt.Print(graph.Chart(*chart))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if len(graph.Shifted) == 0 {
+		fmt.Fprintln(w, "TIME\t"+strings.ToUpper(mgr.Fn.String()))
+		for _, v := range graph.Values {
+			ts := time.Unix(int64(v[0]), 0).In(mgr.Step.Loc()).Format(time.RFC3339)
+			fmt.Fprintln(w, ts+"\t"+format_value(v[1]))
+		}
+		return w.Flush()
+	}
+
+	// a column for each offset's value and change, steps missing on a side are blank
+	header := "TIME\t" + strings.ToUpper(mgr.Fn.String())
+	for _, s := range graph.Shifted {
+		header += "\t-" + s.Offset.String() + "\tCHANGE"
+	}
+	fmt.Fprintln(w, header)
+
+	column := func(values [][2]float64, format func(float64) string) map[float64]string {
+		col := map[float64]string{}
+		for _, v := range values {
+			col[v[0]] = format(v[1])
+		}
+		return col
+	}
+	percent := func(v float64) string { return strconv.FormatFloat(v, 'f', 1, 64) + "%" }
+
+	current := column(graph.Values, format_value)
+	shifted := make([]map[float64]string, 0, len(graph.Shifted))
+	changes := make([]map[float64]string, 0, len(graph.Shifted))
+	for _, s := range graph.Shifted {
+		shifted = append(shifted, column(s.Values, format_value))
+		changes = append(changes, column(s.Change, percent))
+	}
+
+	// every step either side has, shifted values are already on the current window's steps
+	steps := []float64{}
+	for t := range current {
+		steps = append(steps, t)
+	}
+	for _, col := range shifted {
+		for t := range col {
+			if _, exists := current[t]; !exists {
+				current[t] = ""
+				steps = append(steps, t)
+			}
+		}
+	}
+	sort.Float64s(steps)
+
+	for _, t := range steps {
+		row := time.Unix(int64(t), 0).In(mgr.Step.Loc()).Format(time.RFC3339) + "\t" + current[t]
+		for i := range graph.Shifted {
+			row += "\t" + shifted[i][t] + "\t" + changes[i][t]
+		}
+		fmt.Fprintln(w, row)
+	}
+	return w.Flush()
+}
+
+func format_value(v float64) string {
+	// null fill gaps are left blank
+	if math.IsNaN(v) {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func run_metrics(th *tophat.Client, args []string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tKEY\tTAGS\tSTEPS")
+	for _, m := range th.Metrics() {
+		steps := make([]string, 0, len(m.Steps))
+		for _, t := range m.Steps {
+			steps = append(steps, t.Name)
+		}
+		fmt.Fprintln(w, m.Name+"\t"+m.Key+"\t"+strings.Join(m.Tags, ",")+"\t"+strings.Join(steps, ","))
+	}
+	for _, d := range th.DerivedMetrics() {
+		fmt.Fprintln(w, d.Name+"\t= "+d.Expression+"\t"+strings.Join(d.Tags, ",")+"\t-")
+	}
+	return w.Flush()
+}
+
+func run_timesteps(th *tophat.Client, args []string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tKEY\tPERIOD\tWIDTH\tKEEP\tSTEPS\tLOCATION")
+	for _, t := range th.Timesteps() {
+		width := "-"
+		if t.StepWidth > 0 {
+			width = t.StepWidth.String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%s\n", t.Name, t.Key, t.Period, width, t.Keep, t.NumSteps, t.Loc())
+	}
+	return w.Flush()
+}
+
+func run_tags(th *tophat.Client, args []string) error {
+	fs := flag.NewFlagSet("tags", flag.ExitOnError)
+	metric := fs.String("metric", "", "metric name")
+	tag := fs.String("tag", "", "tag name")
+	fs.Parse(args)
+
+	values, err := th.TagValues(*metric, *tag)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range values {
+		fmt.Println(v)
+	}
+	return nil
+}
+
+func run_register(th *tophat.Client, args []string) error {
+	return th.SaveRegistry()
+}
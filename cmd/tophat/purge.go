@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/fancysupport/tophat"
+)
+
+func run_purge(th *tophat.Client, args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	metric := fs.String("metric", "", "metric name")
+	tags := fs.String("tags", "", "only series with these tag values, tag=value,tag=value")
+	from := fs.String("from", "", "only data from this time, unix seconds or RFC3339")
+	to := fs.String("to", "", "only data before this time, unix seconds or RFC3339")
+	dry_run := fs.Bool("dry-run", false, "list what would be removed without removing it")
+	fs.Parse(args)
+
+	pr := tophat.PurgeRequest{
+		MetricName: *metric,
+		Tags:       map[string]string{},
+		DryRun:     *dry_run,
+	}
+
+	if *tags != "" {
+		for _, pair := range strings.Split(*tags, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return errors.New("Tags must look like tag=value: " + pair)
+			}
+			pr.Tags[kv[0]] = kv[1]
+		}
+	}
+
+	var err error
+	if *from != "" {
+		if pr.From, err = parse_time(*from); err != nil {
+			return err
+		}
+	}
+	if *to != "" {
+		if pr.To, err = parse_time(*to); err != nil {
+			return err
+		}
+	}
+
+	// purging a whole metric should be deliberate
+	if len(pr.Tags) == 0 && pr.From.IsZero() && pr.To.IsZero() && !pr.DryRun {
+		return errors.New("Refusing to purge every series for all time, give -tags, -from or -to.")
+	}
+
+	report, err := th.Purge(pr)
+	if err != nil {
+		return err
+	}
+
+	verb := "removed"
+	if pr.DryRun {
+		verb = "would remove"
+	}
+
+	for _, key := range report.Keys {
+		fmt.Println(verb, "key", key)
+	}
+	keys := make([]string, 0, len(report.Fields))
+	for key := range report.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Println(verb, report.Fields[key], "steps from", key)
+	}
+
+	fmt.Printf("%s %d keys and steps from %d keys\n", verb, len(report.Keys), len(report.Fields))
+	return nil
+}
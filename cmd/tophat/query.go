@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/fancysupport/tophat"
+)
+
+func run_query(th *tophat.Client, args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	step := fs.String("step", "hour", "timestep name")
+	fill := fs.Bool("fill", false, "fill empty steps with zero")
+	fill_mode := fs.String("fill-mode", "none", "none, zero, null, previous or linear")
+	num := fs.Int("n", 0, "number of steps, defaults to the timestep's")
+	format := fs.String("format", "table", "table, csv (wide), csv-long or ndjson")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return errors.New(`Give a query, e.g. 'avg(latency{app="test",cid=*}) by (cid) | top(5)'`)
+	}
+
+	t, err := find_step(th, *step)
+	if err != nil {
+		return err
+	}
+	mode, err := tophat.ParseFillMode(*fill_mode)
+	if err != nil {
+		return err
+	}
+
+	graphs, err := th.Query(tophat.QueryRequest{
+		Query:    strings.Join(fs.Args(), " "),
+		Step:     t,
+		NumSteps: *num,
+		Fill:     mode,
+		FillZero: *fill,
+	})
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case "table":
+		// a row per graph, the last value and a sparkline of the rest
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SERIES\tLAST\tGRAPH")
+		for _, g := range graphs {
+			label, last := g.Label(), "-"
+			if label == "" {
+				label = "*"
+			}
+			for i := len(g.Values) - 1; i >= 0; i-- {
+				if v := format_value(g.Values[i][1]); v != "" {
+					last = v
+					break
+				}
+			}
+			fmt.Fprintln(w, label+"\t"+last+"\t"+g.Sparkline())
+		}
+		return w.Flush()
+	case "csv":
+		return tophat.WriteCSVWide(os.Stdout, graphs)
+	case "csv-long":
+		return tophat.WriteCSVLong(os.Stdout, graphs)
+	case "ndjson":
+		return tophat.WriteNDJSON(os.Stdout, graphs)
+	}
+
+	return errors.New("Unknown query format: " + *format)
+}
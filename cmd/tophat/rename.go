@@ -0,0 +1,25 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/fancysupport/tophat"
+)
+
+func run_rename(th *tophat.Client, args []string) error {
+	fs := flag.NewFlagSet("rename", flag.ExitOnError)
+	metric := fs.String("metric", "", "metric name")
+	tag := fs.String("tag", "", "tag name")
+	from := fs.String("from", "", "tag value to move history from")
+	to := fs.String("to", "", "tag value to merge history into")
+	fs.Parse(args)
+
+	moved, err := th.RenameTagValue(*metric, *tag, *from, *to)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("merged %d keys from %s=%s into %s=%s\n", moved, *tag, *from, *tag, *to)
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/fancysupport/tophat"
+)
+
+func run_rollup(th *tophat.Client, args []string) error {
+	fs := flag.NewFlagSet("rollup", flag.ExitOnError)
+	metric := fs.String("metric", "", "metric name, defaults to every rollup metric")
+	grace := fs.Duration("grace", time.Minute, "wait this long after a period ends before rolling it up")
+	every := fs.Duration("every", 0, "keep running at this interval instead of a single pass")
+	fs.Parse(args)
+
+	if *every > 0 {
+		w := &tophat.RollupWorker{
+			Client:   th,
+			Interval: *every,
+			Grace:    *grace,
+			Errors: func(metric string, err error) {
+				fmt.Fprintln(os.Stderr, "rollup", metric+":", err)
+			},
+		}
+		w.Run(nil)
+		return nil
+	}
+
+	metrics := []*tophat.Metric{}
+	if *metric != "" {
+		m, err := find_metric(th, *metric)
+		if err != nil {
+			return err
+		}
+		metrics = append(metrics, m)
+	} else {
+		for _, m := range th.Metrics() {
+			if m.Rollup {
+				metrics = append(metrics, m)
+			}
+		}
+	}
+
+	for _, m := range metrics {
+		report, err := th.Rollup(m.Name, *grace)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: periods: %d fields: %d\n", m.Name, report.Periods, report.Fields)
+	}
+
+	return nil
+}
@@ -0,0 +1,349 @@
+package tophat
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a metric computed step by step from others with the same tags, e.g. a click
+// through rate of clicks.count / impressions.count. it's graphed like any
+// metric by name but never written to.
+//
+// terms are metric.fn, a metric name that isn't a plain identifier can be quoted,
+// e.g. "page-views".count. for each step:
+//   - count and sum terms read a missing step as 0, nothing was written
+//   - min, max and avg terms have no value for a missing step, so neither does the result
+//   - dividing by zero leaves the step missing
+//
+// missing steps are then filled by the request's Fill like any other graph
+type DerivedMetric struct {
+	Name       string
+	Expression string // numbers and terms with + - * / and brackets
+
+	Tags []string // those of the metrics it uses, set when added
+
+	expr  *derived_node
+	terms []*derived_term
+}
+
+type derived_term struct {
+	metric *Metric
+	fn     MetricFn
+}
+
+// an expression tree, leaves are a number or a term
+type derived_node struct {
+	op          byte // + - * / or 0 for a leaf
+	left, right *derived_node
+	value       float64
+	term        *derived_term
+}
+
+func (c *Client) AddDerivedMetric(d *DerivedMetric) error {
+	if _, exists := c.metrics[d.Name]; exists {
+		return errors.New("Metric name already exists.")
+	}
+	if _, exists := c.derived[d.Name]; exists {
+		return errors.New("Metric name already exists.")
+	}
+
+	p := &derived_parser{client: c, src: d.Expression}
+	expr, err := p.parse()
+	if err != nil {
+		return errors.New("Bad expression for derived metric " + d.Name + ": " + err.Error())
+	}
+	if len(p.terms) == 0 {
+		return errors.New("Derived metric " + d.Name + " doesn't use any metrics.")
+	}
+
+	// the tag values of a graph request are passed straight to each metric
+	tags := p.terms[0].metric.Tags
+	for _, t := range p.terms[1:] {
+		if strings.Join(t.metric.Tags, SEP) != strings.Join(tags, SEP) {
+			return errors.New("Derived metric " + d.Name + " uses metrics with different tags. (" + t.metric.Name + ")")
+		}
+	}
+
+	d.Tags = tags
+	d.expr = expr
+	d.terms = p.terms
+	c.derived[d.Name] = d
+
+	return nil
+}
+
+func (c *Client) DerivedMetrics() []*DerivedMetric {
+	list := make([]*DerivedMetric, 0, len(c.derived))
+	for _, d := range c.derived {
+		list = append(list, d)
+	}
+	sort.Sort(derived_list(list))
+	return list
+}
+
+type derived_list []*DerivedMetric
+
+func (l derived_list) Len() int           { return len(l) }
+func (l derived_list) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l derived_list) Less(i, j int) bool { return l[i].Name < l[j].Name }
+
+func (d *DerivedMetric) metrics() []*Metric {
+	// each metric the expression uses once, in the order they appear
+	seen := map[string]bool{}
+	list := []*Metric{}
+	for _, t := range d.terms {
+		if !seen[t.metric.Name] {
+			seen[t.metric.Name] = true
+			list = append(list, t.metric)
+		}
+	}
+	return list
+}
+
+func (c *Client) graph_derived(d *DerivedMetric, mgr MetricGraphRequest) (*MetricGraph, error) {
+	if len(mgr.TagValues) != len(d.Tags) {
+		return nil, errors.New("TagValues don't match the Tags count for the metric.")
+	}
+	now := c.clock.Now()
+	for _, m := range d.metrics() {
+		if !m.has_step(mgr.Step) {
+			return nil, errors.New("That timestep is not in the list for metric " + m.Name + " used by " + d.Name + ".")
+		}
+		if err := m.check_offsets(mgr.Step, mgr.Offsets, now); err != nil {
+			return nil, err
+		}
+	}
+
+	points := func(now time.Time) ([]int64, map[float64]float64, error) {
+		// fetch each metric once however many of its fns are used
+		var list []int64
+		fetched := map[string]map[float64]AggregateHashData{}
+		for _, m := range d.metrics() {
+			l, data, err := m.graph_data(c.store(m, mgr.TagValues), mgr, now)
+			if err != nil {
+				return nil, nil, err
+			}
+			list = l
+			fetched[m.Name] = data
+		}
+
+		unpacked := make(map[float64]float64, len(list))
+		for _, timestamp := range list {
+			t := float64(timestamp)
+			if val, ok := d.expr.eval(fetched, t); ok {
+				unpacked[t] = val
+			}
+		}
+		return list, unpacked, nil
+	}
+
+	return graph_window(d.terms[0].metric.tag_map(mgr.TagValues), mgr, now, points)
+}
+
+func (n *derived_node) eval(fetched map[string]map[float64]AggregateHashData, t float64) (float64, bool) {
+	// the value at a step, false if it's missing
+	if n.op == 0 {
+		if n.term == nil {
+			return n.value, true
+		}
+		data, exists := fetched[n.term.metric.Name][t]
+		if !exists {
+			if n.term.fn == CountFn || n.term.fn == SumFn {
+				return 0, true
+			}
+			return 0, false
+		}
+		return AggregateHashPick(data, n.term.fn), true
+	}
+
+	left, ok := n.left.eval(fetched, t)
+	if !ok {
+		return 0, false
+	}
+	right, ok := n.right.eval(fetched, t)
+	if !ok {
+		return 0, false
+	}
+
+	switch n.op {
+	case '+':
+		return left + right, true
+	case '-':
+		return left - right, true
+	case '*':
+		return left * right, true
+	}
+	if right == 0 {
+		return 0, false
+	}
+	return left / right, true
+}
+
+// recursive descent over
+//
+//	expr    = product { ("+" | "-") product }
+//	product = unary { ("*" | "/") unary }
+//	unary   = "-" unary | number | term | "(" expr ")"
+type derived_parser struct {
+	client *Client
+	src    string
+	pos    int
+	terms  []*derived_term
+}
+
+func (p *derived_parser) parse() (*derived_node, error) {
+	n, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	p.space()
+	if p.pos < len(p.src) {
+		return nil, errors.New("unexpected " + strconv.Quote(p.src[p.pos:]))
+	}
+	return n, nil
+}
+
+func (p *derived_parser) space() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *derived_parser) next(ops string) byte {
+	// consume one of ops if it's next, 0 if not
+	p.space()
+	if p.pos < len(p.src) && strings.IndexByte(ops, p.src[p.pos]) != -1 {
+		p.pos++
+		return p.src[p.pos-1]
+	}
+	return 0
+}
+
+func (p *derived_parser) expr() (*derived_node, error) {
+	left, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.next("+-"); op != 0; op = p.next("+-") {
+		right, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		left = &derived_node{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *derived_parser) product() (*derived_node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.next("*/"); op != 0; op = p.next("*/") {
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = &derived_node{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *derived_parser) unary() (*derived_node, error) {
+	if p.next("-") != 0 {
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &derived_node{op: '-', left: &derived_node{}, right: n}, nil
+	}
+
+	if p.next("(") != 0 {
+		n, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next(")") == 0 {
+			return nil, errors.New("missing )")
+		}
+		return n, nil
+	}
+
+	if p.pos >= len(p.src) {
+		return nil, errors.New("unexpected end")
+	}
+
+	c := p.src[p.pos]
+	switch {
+	case c >= '0' && c <= '9' || c == '.':
+		return p.number()
+	case c == '"' || c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		return p.term()
+	}
+	return nil, errors.New("unexpected " + strconv.Quote(p.src[p.pos:]))
+}
+
+func (p *derived_parser) number() (*derived_node, error) {
+	start := p.pos
+	for p.pos < len(p.src) && (p.src[p.pos] >= '0' && p.src[p.pos] <= '9' || p.src[p.pos] == '.') {
+		p.pos++
+	}
+	v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+	if err != nil {
+		return nil, errors.New("bad number " + p.src[start:p.pos])
+	}
+	return &derived_node{value: v}, nil
+}
+
+func (p *derived_parser) term() (*derived_node, error) {
+	// the fn is after the last dot so plain names can have dots in them too
+	var name, fn string
+	if p.src[p.pos] == '"' {
+		end := strings.IndexByte(p.src[p.pos+1:], '"')
+		if end == -1 {
+			return nil, errors.New("unclosed quote")
+		}
+		name = p.src[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		if p.pos >= len(p.src) || p.src[p.pos] != '.' {
+			return nil, errors.New("missing function after " + strconv.Quote(name))
+		}
+		p.pos++
+		fn = p.ident()
+	} else {
+		full := p.ident()
+		dot := strings.LastIndex(full, ".")
+		if dot == -1 {
+			return nil, errors.New("missing function after " + full + ", e.g. " + full + ".count")
+		}
+		name, fn = full[:dot], full[dot+1:]
+	}
+
+	m, exists := p.client.metrics[name]
+	if !exists {
+		return nil, errors.New("no metric with name " + name)
+	}
+	f, err := ParseMetricFn(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &derived_term{metric: m, fn: f}
+	p.terms = append(p.terms, t)
+	return &derived_node{term: t}, nil
+}
+
+func (p *derived_parser) ident() string {
+	start := p.pos
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c != '_' && c != '.' && !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') {
+			break
+		}
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
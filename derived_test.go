@@ -0,0 +1,121 @@
+package tophat
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func derived_client(t *testing.T) (*Client, time.Time) {
+	// req, err, page-views and api.req for app web in the 10:30 step, nothing at 10:31
+	now := time.Date(2024, 3, 1, 10, 31, 0, 0, time.UTC)
+	c, err := NewMemoryClient(NewManualClock(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"req", "err", "page-views", "api.req"} {
+		if err := c.AddMetric(&Metric{Name: name, Key: name, Tags: []string{"app"}, Steps: []*Timestep{TimestepHour}, Type: DefaultMetric}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.AddMetric(&Metric{Name: "other", Key: "other", Tags: []string{"cid"}, Steps: []*Timestep{TimestepHour}, Type: DefaultMetric}); err != nil {
+		t.Fatal(err)
+	}
+
+	writes := []struct {
+		metric string
+		value  float64
+	}{
+		{"req", 1}, {"req", 2}, {"req", 3}, {"err", 1}, {"page-views", 4}, {"api.req", 5},
+	}
+	for _, w := range writes {
+		if err := c.Write(MetricValue{MetricName: w.metric, TagValues: []string{"web"}, Timestamp: now.Add(-time.Minute), ValueFloat: w.value}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c, now
+}
+
+func TestDerivedExpression(t *testing.T) {
+	c, now := derived_client(t)
+	nan := math.NaN()
+
+	tests := []struct {
+		expression string
+		at, next   float64 // 10:30 then 10:31, NaN for a missing step
+	}{
+		// * and / bind tighter, both sides are left associative
+		{"req.count + 2 * 3", 9, 6},
+		{"(req.count + 2) * 3", 15, 6},
+		{"10 - req.count - 3", 4, 7},
+		{"12 / req.count / 2", 2, nan},
+		{"req.sum - err.count * 2", 4, 0},
+
+		{"-req.count", -3, 0},
+		{"- -2 * req.sum", 12, 0},
+		{"2 * -req.sum + 1", -11, 1},
+		{"-(req.max - req.min)", -2, nan},
+
+		{`"page-views".sum / req.count`, 4.0 / 3, nan},
+		{"api.req.sum + 1", 6, 1},
+		{`"api.req".max`, 5, nan},
+
+		// count and sum are 0 without writes, min max and avg have no value
+		{"err.count / req.count", 1.0 / 3, nan},
+		{"req.count / (err.count - 1)", nan, 0},
+		{"req.avg", 2, nan},
+		{"req.min + err.count", 2, nan},
+	}
+
+	for i, tt := range tests {
+		name := "d" + string(rune('a'+i))
+		if err := c.AddDerivedMetric(&DerivedMetric{Name: name, Expression: tt.expression}); err != nil {
+			t.Errorf("%q: %v", tt.expression, err)
+			continue
+		}
+		g, err := c.Graph(MetricGraphRequest{MetricName: name, TagValues: []string{"web"}, Step: TimestepHour, NumSteps: 2, Fill: NullFill})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := [][2]float64{{float64(now.Add(-time.Minute).Unix()), tt.at}, {float64(now.Unix()), tt.next}}
+		if !same_values(g.Values, want) {
+			t.Errorf("%q: got %v, want %v", tt.expression, g.Values, want)
+		}
+	}
+}
+
+func TestDerivedExpressionErrors(t *testing.T) {
+	c, _ := derived_client(t)
+
+	tests := []struct {
+		expression string
+		err        string
+	}{
+		{"", "Bad expression for derived metric d: unexpected end"},
+		{"req.count +", "Bad expression for derived metric d: unexpected end"},
+		{"(req.count", "Bad expression for derived metric d: missing )"},
+		{"req.count )", `Bad expression for derived metric d: unexpected ")"`},
+		{"req.count # 2", `Bad expression for derived metric d: unexpected "# 2"`},
+		{"1..2 * req.count", "Bad expression for derived metric d: bad number 1..2"},
+		{"req", "Bad expression for derived metric d: missing function after req, e.g. req.count"},
+		{`"page-views"`, `Bad expression for derived metric d: missing function after "page-views"`},
+		{`"page-views.count`, "Bad expression for derived metric d: unclosed quote"},
+		{"req.median", "Bad expression for derived metric d: Unknown metric function: median"},
+		{"nope.count", "Bad expression for derived metric d: no metric with name nope"},
+		{"page-views.count", "Bad expression for derived metric d: missing function after page, e.g. page.count"},
+
+		{"1 + 2", "Derived metric d doesn't use any metrics."},
+		{"req.count / other.count", "Derived metric d uses metrics with different tags. (other)"},
+	}
+
+	for _, tt := range tests {
+		err := c.AddDerivedMetric(&DerivedMetric{Name: "d", Expression: tt.expression})
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%q: got error %v, want %q", tt.expression, err, tt.err)
+		}
+	}
+
+	if err := c.AddDerivedMetric(&DerivedMetric{Name: "req", Expression: "err.count"}); err == nil || err.Error() != "Metric name already exists." {
+		t.Errorf("derived metric named req: got error %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package tophat
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type ExportRow struct {
+	Timestamp string            `json:"timestamp"`
+	Tags      map[string]string `json:"tags"`
+	Value     float64           `json:"value"`
+}
+
+func (r ExportRow) MarshalJSON() ([]byte, error) {
+	// a NaN gap from NullFill is written as null
+	var value *float64
+	if !math.IsNaN(r.Value) && !math.IsInf(r.Value, 0) {
+		value = &r.Value
+	}
+	return json.Marshal(struct {
+		Timestamp string            `json:"timestamp"`
+		Tags      map[string]string `json:"tags"`
+		Value     *float64          `json:"value"`
+	}{r.Timestamp, r.Tags, value})
+}
+
+func (r *ExportRow) UnmarshalJSON(data []byte) error {
+	// null comes back as NaN so a gap isn't read as a 0
+	var row struct {
+		Timestamp string            `json:"timestamp"`
+		Tags      map[string]string `json:"tags"`
+		Value     *float64          `json:"value"`
+	}
+	if err := json.Unmarshal(data, &row); err != nil {
+		return err
+	}
+
+	r.Timestamp, r.Tags, r.Value = row.Timestamp, row.Tags, math.NaN()
+	if row.Value != nil {
+		r.Value = *row.Value
+	}
+	return nil
+}
+
+func WriteCSVWide(w io.Writer, graphs []*MetricGraph) error {
+	// one row per timestamp, one column per graph, blank where a graph has no value
+	header := make([]string, 0, len(graphs)+1)
+	header = append(header, "timestamp")
+	for _, g := range graphs {
+		header = append(header, g.Label())
+	}
+
+	stamps := export_timestamps(graphs)
+	lookup := make([]map[float64]float64, len(graphs))
+	for i, g := range graphs {
+		lookup[i] = make(map[float64]float64, len(g.Values))
+		for _, v := range g.Values {
+			lookup[i][v[0]] = v[1]
+		}
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	for _, ts := range stamps {
+		row := make([]string, 0, len(graphs)+1)
+		row = append(row, export_time(ts))
+		for i := range graphs {
+			if v, exists := lookup[i][ts]; exists {
+				row = append(row, export_value(v))
+			} else {
+				row = append(row, "")
+			}
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func WriteCSVLong(w io.Writer, graphs []*MetricGraph) error {
+	// one row per value: timestamp, a column per tag, value
+	tags := export_tags(graphs)
+
+	header := make([]string, 0, len(tags)+2)
+	header = append(header, "timestamp")
+	header = append(header, tags...)
+	header = append(header, "value")
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	for _, g := range graphs {
+		for _, v := range g.Values {
+			row := make([]string, 0, len(header))
+			row = append(row, export_time(v[0]))
+			for _, t := range tags {
+				row = append(row, g.Tags[t])
+			}
+			row = append(row, export_value(v[1]))
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func WriteNDJSON(w io.Writer, graphs []*MetricGraph) error {
+	// one json object per value per line
+	enc := json.NewEncoder(w)
+	for _, g := range graphs {
+		for _, v := range g.Values {
+			row := ExportRow{
+				Timestamp: export_time(v[0]),
+				Tags:      g.Tags,
+				Value:     v[1],
+			}
+			if err := enc.Encode(row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func export_timestamps(graphs []*MetricGraph) []float64 {
+	seen := map[float64]bool{}
+	stamps := []float64{}
+	for _, g := range graphs {
+		for _, v := range g.Values {
+			if !seen[v[0]] {
+				seen[v[0]] = true
+				stamps = append(stamps, v[0])
+			}
+		}
+	}
+	sort.Float64s(stamps)
+	return stamps
+}
+
+func export_tags(graphs []*MetricGraph) []string {
+	seen := map[string]bool{}
+	tags := []string{}
+	for _, g := range graphs {
+		for t := range g.Tags {
+			if !seen[t] {
+				seen[t] = true
+				tags = append(tags, t)
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func export_time(ts float64) string {
+	// iso 8601
+	return time.Unix(int64(ts), 0).UTC().Format(time.RFC3339)
+}
+
+func export_value(v float64) string {
+	// gaps are blank like steps a graph doesn't have
+	if math.IsNaN(v) {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,45 @@
+package tophat
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestExportRowJSON(t *testing.T) {
+	// gaps are written as null and read back as NaN, not 0
+	tests := []struct {
+		row  ExportRow
+		json string
+	}{
+		{ExportRow{Timestamp: "2024-03-01T10:30:00Z", Tags: map[string]string{"page": "home"}, Value: 2.5},
+			`{"timestamp":"2024-03-01T10:30:00Z","tags":{"page":"home"},"value":2.5}`},
+		{ExportRow{Timestamp: "2024-03-01T10:31:00Z", Tags: map[string]string{"page": "home"}, Value: 0},
+			`{"timestamp":"2024-03-01T10:31:00Z","tags":{"page":"home"},"value":0}`},
+		{ExportRow{Timestamp: "2024-03-01T10:32:00Z", Tags: map[string]string{"page": "home"}, Value: math.NaN()},
+			`{"timestamp":"2024-03-01T10:32:00Z","tags":{"page":"home"},"value":null}`},
+	}
+
+	for _, tt := range tests {
+		data, err := json.Marshal(tt.row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tt.json {
+			t.Errorf("got %s, want %s", data, tt.json)
+		}
+
+		var back ExportRow
+		if err := json.Unmarshal(data, &back); err != nil {
+			t.Fatal(err)
+		}
+		if back.Timestamp != tt.row.Timestamp || back.Tags["page"] != "home" || !same_values([][2]float64{{0, back.Value}}, [][2]float64{{0, tt.row.Value}}) {
+			t.Errorf("%s came back as %+v", data, back)
+		}
+	}
+
+	var row ExportRow
+	if err := json.Unmarshal([]byte(`{"timestamp":"2024-03-01T10:30:00Z"}`), &row); err != nil || !math.IsNaN(row.Value) {
+		t.Errorf("a row without a value came back as %v, %v", row.Value, err)
+	}
+}
@@ -0,0 +1,159 @@
+package tophat
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+)
+
+type FillMode int
+
+const (
+	NoFill       FillMode = iota // empty steps are left out
+	ZeroFill                     // empty steps are 0
+	NullFill                     // empty steps are NaN, null in json, so charts can show gaps
+	PreviousFill                 // empty steps repeat the value before them
+	LinearFill                   // empty steps are interpolated between the values either side
+)
+
+var fill_names = map[FillMode]string{
+	NoFill:       "none",
+	ZeroFill:     "zero",
+	NullFill:     "null",
+	PreviousFill: "previous",
+	LinearFill:   "linear",
+}
+
+func (f FillMode) String() string {
+	if name, exists := fill_names[f]; exists {
+		return name
+	}
+	return "unknown"
+}
+
+func ParseFillMode(name string) (FillMode, error) {
+	for f, n := range fill_names {
+		if n == name {
+			return f, nil
+		}
+	}
+	return 0, errors.New("Unknown fill mode: " + name)
+}
+
+func (mgr MetricGraphRequest) fill_mode() FillMode {
+	// FillZero still works when Fill isn't set
+	if mgr.Fill == NoFill && mgr.FillZero {
+		return ZeroFill
+	}
+	return mgr.Fill
+}
+
+func graph_values(list []int64, unpacked map[float64]float64, fill FillMode) [][2]float64 {
+	// assemble the sorted array of arrays, filling empty steps as asked
+	// previous and linear only fill between values in the window, so steps
+	// before the first value, and after the last for linear, are left out
+	values := make([][2]float64, 0, len(list))
+	for i, timestamp := range list {
+		t := float64(timestamp)
+		if val, exists := unpacked[t]; exists {
+			values = append(values, [2]float64{t, val})
+			continue
+		}
+
+		switch fill {
+		case ZeroFill:
+			values = append(values, [2]float64{t, 0})
+
+		case NullFill:
+			values = append(values, [2]float64{t, math.NaN()})
+
+		case PreviousFill:
+			if len(values) > 0 {
+				values = append(values, [2]float64{t, values[len(values)-1][1]})
+			}
+
+		case LinearFill:
+			if len(values) == 0 {
+				continue
+			}
+			for _, next := range list[i+1:] {
+				n := float64(next)
+				if after, exists := unpacked[n]; exists {
+					before := values[len(values)-1]
+					values = append(values, [2]float64{t, before[1] + (after-before[1])*(t-before[0])/(n-before[0])})
+					break
+				}
+			}
+		}
+	}
+	return values
+}
+
+// a graph's [timestamp, value] pairs. values can be NaN for steps with no
+// data, they're written as null in json as json has no NaN
+type GraphValues [][2]float64
+
+func (gv GraphValues) MarshalJSON() ([]byte, error) {
+	if gv == nil {
+		return []byte("null"), nil
+	}
+
+	b := &bytes.Buffer{}
+	b.WriteByte('[')
+	for i, v := range gv {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteByte('[')
+		b.WriteString(json_float(v[0]))
+		b.WriteByte(',')
+		b.WriteString(json_float(v[1]))
+		b.WriteByte(']')
+	}
+	b.WriteByte(']')
+	return b.Bytes(), nil
+}
+
+func (gv *GraphValues) UnmarshalJSON(data []byte) error {
+	// nulls come back as NaN
+	var raw [][2]*float64
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if raw == nil {
+		*gv = nil
+		return nil
+	}
+
+	values := make(GraphValues, len(raw))
+	for i, v := range raw {
+		for j := range v {
+			values[i][j] = math.NaN()
+			if v[j] != nil {
+				values[i][j] = *v[j]
+			}
+		}
+	}
+	*gv = values
+	return nil
+}
+
+func json_float(v float64) string {
+	// formatted the way encoding/json does, null for what json can't hold
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return "null"
+	}
+	abs := math.Abs(v)
+	if abs == 0 || abs >= 1e-6 && abs < 1e21 {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	// 1e-07 is written 1e-7
+	s := strconv.FormatFloat(v, 'e', -1, 64)
+	if n := len(s); n >= 4 && s[n-4] == 'e' && s[n-3] == '-' && s[n-2] == '0' {
+		s = s[:n-2] + s[n-1:]
+	}
+	return s
+}
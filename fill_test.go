@@ -0,0 +1,188 @@
+package tophat
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+// compares values with NaN equal to NaN, as gaps are
+func same_values(a, b [][2]float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		for j := range a[i] {
+			if a[i][j] != b[i][j] && !(math.IsNaN(a[i][j]) && math.IsNaN(b[i][j])) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestGraphValuesFill(t *testing.T) {
+	nan := math.NaN()
+
+	// a gap before the first value, one between values and three after the last
+	list := []int64{0, 60, 120, 180, 240, 300, 360}
+	unpacked := map[float64]float64{60: 10, 180: 40}
+
+	// the first and last steps have values, with a run of gaps between
+	ends := map[float64]float64{0: 0, 240: 40}
+
+	tests := []struct {
+		fill     FillMode
+		unpacked map[float64]float64
+		want     [][2]float64
+	}{
+		{NoFill, unpacked, [][2]float64{{60, 10}, {180, 40}}},
+		{ZeroFill, unpacked, [][2]float64{{0, 0}, {60, 10}, {120, 0}, {180, 40}, {240, 0}, {300, 0}, {360, 0}}},
+		{NullFill, unpacked, [][2]float64{{0, nan}, {60, 10}, {120, nan}, {180, 40}, {240, nan}, {300, nan}, {360, nan}}},
+		{PreviousFill, unpacked, [][2]float64{{60, 10}, {120, 10}, {180, 40}, {240, 40}, {300, 40}, {360, 40}}},
+		{LinearFill, unpacked, [][2]float64{{60, 10}, {120, 25}, {180, 40}}},
+
+		{PreviousFill, ends, [][2]float64{{0, 0}, {60, 0}, {120, 0}, {180, 0}, {240, 40}, {300, 40}, {360, 40}}},
+		{LinearFill, ends, [][2]float64{{0, 0}, {60, 10}, {120, 20}, {180, 30}, {240, 40}}},
+
+		// nothing to fill from
+		{PreviousFill, map[float64]float64{}, [][2]float64{}},
+		{LinearFill, map[float64]float64{360: 1}, [][2]float64{{360, 1}}},
+		{NullFill, map[float64]float64{}, [][2]float64{{0, nan}, {60, nan}, {120, nan}, {180, nan}, {240, nan}, {300, nan}, {360, nan}}},
+	}
+
+	for _, tt := range tests {
+		if got := graph_values(list, tt.unpacked, tt.fill); !same_values(got, tt.want) {
+			t.Errorf("%s fill of %v: got %v, want %v", tt.fill, tt.unpacked, got, tt.want)
+		}
+	}
+}
+
+func TestFillMode(t *testing.T) {
+	tests := []struct {
+		mgr  MetricGraphRequest
+		want FillMode
+	}{
+		{MetricGraphRequest{}, NoFill},
+		{MetricGraphRequest{FillZero: true}, ZeroFill},
+		{MetricGraphRequest{Fill: NullFill}, NullFill},
+		{MetricGraphRequest{Fill: LinearFill, FillZero: true}, LinearFill},
+	}
+	for _, tt := range tests {
+		if got := tt.mgr.fill_mode(); got != tt.want {
+			t.Errorf("Fill %s FillZero %v: got %s, want %s", tt.mgr.Fill, tt.mgr.FillZero, got, tt.want)
+		}
+	}
+
+	for f := range fill_names {
+		parsed, err := ParseFillMode(f.String())
+		if err != nil || parsed != f {
+			t.Errorf("%s parsed as %s, %v", f, parsed, err)
+		}
+	}
+	if _, err := ParseFillMode("nope"); err == nil {
+		t.Error("parsed an unknown fill mode")
+	}
+}
+
+func TestGraphFillZero(t *testing.T) {
+	// a request with only FillZero set graphs the same as one with ZeroFill
+	clock := NewManualClock(time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC))
+	c, err := NewMemoryClient(clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.AddMetric(&Metric{Name: "hits", Key: "hits", Tags: []string{"page"}, Steps: []*Timestep{TimestepHour}, Type: DefaultMetric})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ago := range []time.Duration{0, 3 * time.Minute} {
+		err := c.Write(MetricValue{MetricName: "hits", TagValues: []string{"home"}, Timestamp: clock.Now().Add(-ago), ValueFloat: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mgr := MetricGraphRequest{MetricName: "hits", TagValues: []string{"home"}, Step: TimestepHour, Fn: CountFn, NumSteps: 5}
+	mgr.FillZero = true
+	old, err := c.Graph(mgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgr.FillZero = false
+	mgr.Fill = ZeroFill
+	filled, err := c.Graph(mgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := float64(clock.Now().Unix() - 4*60)
+	want := [][2]float64{{start, 0}, {start + 60, 1}, {start + 120, 0}, {start + 180, 0}, {start + 240, 1}}
+	if !same_values(old.Values, want) {
+		t.Errorf("FillZero: got %v, want %v", old.Values, want)
+	}
+	if !same_values(filled.Values, want) {
+		t.Errorf("ZeroFill: got %v, want %v", filled.Values, want)
+	}
+}
+
+func TestGraphValuesJSON(t *testing.T) {
+	tests := []struct {
+		values GraphValues
+		json   string
+	}{
+		{nil, `null`},
+		{GraphValues{}, `[]`},
+		{GraphValues{{1709287800, 2.5}, {1709287860, math.NaN()}, {1709287920, -3}}, `[[1709287800,2.5],[1709287860,null],[1709287920,-3]]`},
+	}
+
+	for _, tt := range tests {
+		data, err := json.Marshal(tt.values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tt.json {
+			t.Errorf("got %s, want %s", data, tt.json)
+		}
+
+		// nulls come back as NaN
+		var back GraphValues
+		if err := json.Unmarshal(data, &back); err != nil {
+			t.Fatal(err)
+		}
+		if (back == nil) != (tt.values == nil) || !same_values(back, tt.values) {
+			t.Errorf("%s came back as %v, want %v", data, back, tt.values)
+		}
+	}
+
+	var bad GraphValues
+	if err := json.Unmarshal([]byte(`[[1,"x"]]`), &bad); err == nil {
+		t.Error("unmarshalled a string value")
+	}
+}
+
+func TestJSONFloat(t *testing.T) {
+	// ordinary floats come out exactly as encoding/json writes them
+	floats := []float64{
+		0, math.Copysign(0, -1), 1, -1, 0.1, 2.5, -3.25, 1.0 / 3, 1709287800, 1e20, 123456789.125,
+		1e21, 1.5e21, -1e22, math.MaxFloat64,
+		1e-6, 1.5e-6, 9.99e-7, 1e-7, -1.5e-7, 1e-10, 1e-100, 5e-324,
+	}
+
+	for _, f := range floats {
+		want, err := json.Marshal(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := json_float(f); got != string(want) {
+			t.Errorf("json_float(%g) = %s, encoding/json gives %s", f, got, want)
+		}
+	}
+
+	for _, f := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		if got := json_float(f); got != "null" {
+			t.Errorf("json_float(%g) = %s, want null", f, got)
+		}
+	}
+}
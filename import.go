@@ -0,0 +1,105 @@
+package tophat
+
+import (
+	"math"
+	"strconv"
+)
+
+// how many writes are batched up before they go to storage
+const import_batch = 500
+
+type ImportReport struct {
+	Written      int          // rows written to at least one timestep
+	StepsWritten int          // individual timestep writes
+	StepsExpired int          // timestep writes dropped as their retention has passed
+	Skipped      []ImportSkip // rows not written at all
+}
+
+type ImportSkip struct {
+	Index  int // position in the imported values
+	Reason string
+}
+
+func (c *Client) Import(values []MetricValue) (*ImportReport, error) {
+	// a backfill version of Write for historical values
+	// Write would set an expiry from the value's timestamp, for old values that is in the past
+	// and redis drops the key straight away, so steps past their retention are skipped here
+	// and everything else is written in batches
+	report := &ImportReport{}
+	now := c.clock.Now().UTC()
+
+	// writes waiting for each shard
+	batches := map[int][]AggregateWrite{}
+	pending := 0
+	flush := func() error {
+		for shard, writes := range batches {
+			if err := c.stores[shard].Aggregate(writes); err != nil {
+				return err
+			}
+			delete(batches, shard)
+		}
+		pending = 0
+		return nil
+	}
+
+	for i, mv := range values {
+		// NaN is a gap in an export, there's nothing to write
+		if math.IsNaN(mv.ValueFloat) || math.IsInf(mv.ValueFloat, 0) {
+			report.Skipped = append(report.Skipped, ImportSkip{Index: i, Reason: "No value to write."})
+			continue
+		}
+
+		m, err := c.value_metric(mv)
+		if err == nil {
+			mv, err = c.apply_rules(m, mv)
+		}
+		if err != nil {
+			report.Skipped = append(report.Skipped, ImportSkip{Index: i, Reason: err.Error()})
+			continue
+		}
+
+		shard := c.shard_of(m, mv.TagValues)
+
+		// every timestep, even for rollup metrics, as the finer data may be long gone
+		written := 0
+		for _, step := range m.Steps {
+			expires := m.PeriodExpireAt(step, mv.Timestamp)
+			if expires <= now.Unix() {
+				report.StepsExpired++
+				continue
+			}
+
+			batches[shard] = append(batches[shard], AggregateWrite{
+				Key:      m.write_key(mv, step, false),
+				Field:    step.PeriodStep(mv.Timestamp),
+				Value:    mv.ValueFloat,
+				ExpireAt: expires,
+			})
+			pending++
+			written++
+
+			if pending >= import_batch {
+				if err := flush(); err != nil {
+					return report, err
+				}
+			}
+		}
+
+		if written == 0 {
+			report.Skipped = append(report.Skipped, ImportSkip{
+				Index:  i,
+				Reason: "Retention passed for every timestep (" + strconv.FormatInt(mv.Timestamp.Unix(), 10) + ")",
+			})
+			continue
+		}
+
+		report.Written++
+		report.StepsWritten += written
+	}
+
+	if err := flush(); err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
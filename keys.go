@@ -0,0 +1,185 @@
+package tophat
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// % and SEP would make tag values ambiguous in keys and braces would break
+// cluster hash tags, so they are percent encoded. values without them are
+// written as they always were so existing keys don't change
+var tag_escaper = strings.NewReplacer("%", "%25", SEP, "%3A", "{", "%7B", "}", "%7D")
+
+func escape_tag(v string) string {
+	return tag_escaper.Replace(v)
+}
+
+func unescape_tag(v string) (string, bool) {
+	// only the exact encoding escape_tag makes is accepted, so anything
+	// written before values were escaped shows up as not ok
+	buf := make([]byte, 0, len(v))
+	for i := 0; i < len(v); i++ {
+		if v[i] != '%' {
+			buf = append(buf, v[i])
+			continue
+		}
+		if i+2 >= len(v) {
+			return "", false
+		}
+		b, err := strconv.ParseUint(v[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", false
+		}
+		buf = append(buf, byte(b))
+		i += 2
+	}
+
+	u := string(buf)
+	if escape_tag(u) != v {
+		return "", false
+	}
+	return u, true
+}
+
+// the parts of a key as written by a metric
+type KeyParts struct {
+	MetricKey string
+	TagValues []string
+	Start     int64 // period start, unix seconds
+	StepKey   string
+	Layout    KeyLayout
+}
+
+func ParseKey(key string) (*KeyParts, error) {
+	// decode a key without knowing its metric, which only works for
+	// metric keys without SEP in them. Client.ParseKey checks loaded metrics
+	kp := &KeyParts{}
+
+	rest := key
+	if strings.HasPrefix(rest, "{") {
+		i := strings.LastIndex(rest, "}"+SEP)
+		if i == -1 {
+			return nil, errors.New("Unclosed hash tag in key: " + key)
+		}
+		rest = rest[1:i] + rest[i+1:]
+		kp.Layout = ClusterKeyLayout
+	}
+
+	parts := strings.Split(rest, SEP)
+	if len(parts) < 3 {
+		return nil, errors.New("Too few parts for a metric key: " + key)
+	}
+
+	start, err := strconv.ParseInt(parts[len(parts)-2], 10, 64)
+	if err != nil {
+		return nil, errors.New("Bad period start in key: " + key)
+	}
+
+	kp.MetricKey = parts[0]
+	kp.Start = start
+	kp.StepKey = parts[len(parts)-1]
+	for _, raw := range parts[1 : len(parts)-2] {
+		v, ok := unescape_tag(raw)
+		if !ok {
+			return nil, errors.New("Badly escaped tag value (" + raw + ") in key: " + key)
+		}
+		kp.TagValues = append(kp.TagValues, v)
+	}
+
+	return kp, nil
+}
+
+func (c *Client) ParseKey(key string) (*Metric, *KeyParts, error) {
+	// decode a key written by one of the loaded metrics
+	for _, m := range c.Metrics() {
+		if tag_values, start, step_key, ok := m.parse_key(key); ok {
+			return m, &KeyParts{
+				MetricKey: m.Key,
+				TagValues: tag_values,
+				Start:     start,
+				StepKey:   step_key,
+				Layout:    m.Layout,
+			}, nil
+		}
+	}
+	return nil, nil, errors.New("Key doesn't belong to a loaded metric: " + key)
+}
+
+type MigrateKeysRequest struct {
+	MetricName string
+
+	// turns the raw tag parts of a key with more parts than the metric has tags
+	// back into tag values, e.g. by joining the extras into the tag known to
+	// contain SEP. false skips the key. optional, without it those keys are skipped
+	Split func(raw []string) ([]string, bool)
+
+	DryRun bool // report what would move without moving it
+}
+
+type MigrateKeysReport struct {
+	Moved   map[string]string // old key => new key
+	Skipped []string          // keys that couldn't be decoded
+}
+
+func (c *Client) MigrateKeys(mr MigrateKeysRequest) (*MigrateKeysReport, error) {
+	// move keys written before tag values were escaped onto their escaped keys
+	// a key needs moving if it doesn't parse now, i.e. a tag value had SEP, %
+	// or braces in it. values that happen to look escaped already, like a%3Ab,
+	// can't be told apart from new keys and are left alone
+	m, exists := c.metrics[mr.MetricName]
+	if !exists {
+		return nil, errors.New("No metric with name: " + mr.MetricName)
+	}
+
+	report := &MigrateKeysReport{Moved: map[string]string{}}
+
+	err := c.scan_keys(filter_match(m, make([]string, len(m.Tags)), ""), func(store Storage, key string) error {
+		if _, _, _, ok := m.parse_key(key); ok {
+			return nil
+		}
+
+		parts, ok := m.key_parts(key)
+		if !ok || len(parts) < len(m.Tags)+2 {
+			return nil
+		}
+		start, step_key, ok := m.key_period(parts)
+		if !ok {
+			return nil
+		}
+
+		raw := parts[:len(parts)-2]
+		tag_values := raw
+		if len(raw) != len(m.Tags) {
+			if mr.Split == nil {
+				report.Skipped = append(report.Skipped, key)
+				return nil
+			}
+			if tag_values, ok = mr.Split(raw); !ok || len(tag_values) != len(m.Tags) {
+				report.Skipped = append(report.Skipped, key)
+				return nil
+			}
+		}
+
+		var step *Timestep
+		for _, s := range m.Steps {
+			if s.Key == step_key {
+				step = s
+			}
+		}
+		dst := m.write_key(MetricValue{TagValues: tag_values, Timestamp: time.Unix(start, 0)}, step, false)
+
+		report.Moved[key] = dst
+		if mr.DryRun {
+			return nil
+		}
+
+		if _, err := c.move_key(store, c.store(m, tag_values), key, dst); err != nil {
+			return errors.New("Failed moving " + key + " to " + dst + " " + err.Error())
+		}
+		return nil
+	})
+
+	return report, err
+}
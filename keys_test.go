@@ -0,0 +1,217 @@
+package tophat
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEscapeTag(t *testing.T) {
+	tests := []struct {
+		value, escaped string
+	}{
+		{"plain", "plain"},
+		{"", ""},
+		{"a:b", "a%3Ab"},
+		{"100%", "100%25"},
+		{"%3A", "%253A"},
+		{"{slot}", "%7Bslot%7D"},
+		{"::", "%3A%3A"},
+		{"é:ü", "é%3Aü"},
+	}
+
+	for _, tt := range tests {
+		if got := escape_tag(tt.value); got != tt.escaped {
+			t.Errorf("escape_tag(%q) = %q, want %q", tt.value, got, tt.escaped)
+		}
+		if got, ok := unescape_tag(tt.escaped); !ok || got != tt.value {
+			t.Errorf("unescape_tag(%q) = %q, %v, want %q", tt.escaped, got, ok, tt.value)
+		}
+	}
+
+	// only what escape_tag writes comes back, anything else is an old unescaped value
+	for _, raw := range []string{"100%", "%3", "%zz", "%41", "%3a", "a{b"} {
+		if got, ok := unescape_tag(raw); ok {
+			t.Errorf("unescape_tag(%q) = %q, want not ok", raw, got)
+		}
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want *KeyParts
+		err  string
+	}{
+		{key: "req:web:a:1709283600:h", want: &KeyParts{MetricKey: "req", TagValues: []string{"web", "a"}, Start: 1709283600, StepKey: "h"}},
+		{key: "req:a%3Ab:100%25:1709283600:d", want: &KeyParts{MetricKey: "req", TagValues: []string{"a:b", "100%"}, Start: 1709283600, StepKey: "d"}},
+		{key: "{req:%7Bx%7D}:1709283600:h", want: &KeyParts{MetricKey: "req", TagValues: []string{"{x}"}, Start: 1709283600, StepKey: "h", Layout: ClusterKeyLayout}},
+
+		{key: "req:1709283600", err: "Too few parts for a metric key: req:1709283600"},
+		{key: "req:web:now:h", err: "Bad period start in key: req:web:now:h"},
+		{key: "req:100%:1709283600:h", err: "Badly escaped tag value (100%) in key: req:100%:1709283600:h"},
+		{key: "{req:web:1709283600:h", err: "Unclosed hash tag in key: {req:web:1709283600:h"},
+	}
+
+	for _, tt := range tests {
+		kp, err := ParseKey(tt.key)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%q: got error %v, want %q", tt.key, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.key, err)
+			continue
+		}
+		if !reflect.DeepEqual(kp, tt.want) {
+			t.Errorf("%q: got %+v, want %+v", tt.key, kp, tt.want)
+		}
+	}
+}
+
+func TestClientParseKey(t *testing.T) {
+	// keys written by each metric parse back to the values they were written with
+	c, err := NewMemoryClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := []*Metric{
+		{Name: "req", Key: "req", Tags: []string{"app", "path"}, Steps: []*Timestep{TimestepHour}, Type: DefaultMetric},
+		{Name: "total", Key: "total", Steps: []*Timestep{TimestepHour}, Type: DefaultMetric},
+		{Name: "slot", Key: "slot", Tags: []string{"app"}, Steps: []*Timestep{TimestepDay}, Type: DefaultMetric, Layout: ClusterKeyLayout},
+	}
+	for _, m := range metrics {
+		if err := c.AddMetric(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts := time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		metric     string
+		tag_values []string
+		step       *Timestep
+		key        string
+	}{
+		{"req", []string{"web", "/a:b"}, TimestepHour, "req:web:/a%3Ab:1709287200:h"},
+		{"req", []string{"", "%{}"}, TimestepHour, "req::%25%7B%7D:1709287200:h"},
+		{"total", []string{}, TimestepHour, "total::1709287200:h"},
+		{"slot", []string{"a:{b}"}, TimestepDay, "{slot:a%3A%7Bb%7D}:1709251200:d"},
+	}
+
+	for _, tt := range tests {
+		m := c.metrics[tt.metric]
+		key := m.write_key(MetricValue{TagValues: tt.tag_values, Timestamp: ts}, tt.step, false)
+		if key != tt.key {
+			t.Errorf("%s %q: wrote %q, want %q", tt.metric, tt.tag_values, key, tt.key)
+		}
+
+		found, kp, err := c.ParseKey(key)
+		if err != nil {
+			t.Errorf("%q: %v", key, err)
+			continue
+		}
+		want := &KeyParts{MetricKey: m.Key, TagValues: tt.tag_values, Start: tt.step.StartOfPeriod(ts), StepKey: tt.step.Key, Layout: m.Layout}
+		if found != m || !reflect.DeepEqual(kp, want) {
+			t.Errorf("%q: got %s %+v, want %s %+v", key, found.Name, kp, m.Name, want)
+		}
+	}
+
+	for _, key := range []string{"req:web:1709287200:h", "total:x:1709287200:h", "other::1709287200:h", "slot:a:1709251200:d"} {
+		if m, _, err := c.ParseKey(key); err == nil {
+			t.Errorf("%q parsed for %s", key, m.Name)
+		}
+	}
+}
+
+func TestMigrateKeys(t *testing.T) {
+	// keys written before tag values were escaped, the path tag is known to have SEP in it
+	clock := NewManualClock(time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC))
+	c, err := NewMemoryClient(clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.AddMetric(&Metric{Name: "req", Key: "req", Tags: []string{"app", "path"}, Steps: []*Timestep{TimestepHour}, Type: DefaultMetric})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := c.stores[0]
+
+	old := map[string]float64{
+		"req:web:/a:b:1709287200:h": 1, // split back into web, /a:b
+		"req:web:50%:1709287200:h":  2,
+		"req:{x}:/:1709287200:h":    3,
+		"req:web:/ok:1709287200:h":  4, // already parses
+		"req:a:b:c:d:1709287200:h":  5, // can't tell which tag has the extra parts
+		"req:a%3Ab:/:1709287200:h":  6, // looks escaped, left alone
+	}
+	for key, v := range old {
+		if err := store.Aggregate([]AggregateWrite{{Key: key, Field: 30, Value: v, ExpireAt: 1709294400}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	split := func(raw []string) ([]string, bool) {
+		if raw[0] != "web" {
+			return nil, false
+		}
+		return []string{raw[0], strings.Join(raw[1:], SEP)}, true
+	}
+	want := map[string]string{
+		"req:web:/a:b:1709287200:h": "req:web:/a%3Ab:1709287200:h",
+		"req:web:50%:1709287200:h":  "req:web:50%25:1709287200:h",
+		"req:{x}:/:1709287200:h":    "req:%7Bx%7D:/:1709287200:h",
+	}
+
+	report, err := c.MigrateKeys(MigrateKeysRequest{MetricName: "req", Split: split, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Moved, want) || !reflect.DeepEqual(report.Skipped, []string{"req:a:b:c:d:1709287200:h"}) {
+		t.Errorf("dry run: moved %v skipped %v, want %v", report.Moved, report.Skipped, want)
+	}
+	if fields, _ := store.Fetch("req:web:/a:b:1709287200:h"); len(fields) != 1 {
+		t.Error("dry run moved a key")
+	}
+
+	report, err = c.MigrateKeys(MigrateKeysRequest{MetricName: "req", Split: split})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Moved, want) {
+		t.Errorf("moved %v, want %v", report.Moved, want)
+	}
+	for src, dst := range want {
+		if fields, _ := store.Fetch(src); len(fields) != 0 {
+			t.Errorf("%q is still there", src)
+		}
+		fields, err := store.Fetch(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fields[30].Sum != old[src] {
+			t.Errorf("%q moved to %q with %+v, want sum %g", src, dst, fields[30], old[src])
+		}
+	}
+
+	// the moved values graph under their real tag values
+	g, err := c.Graph(MetricGraphRequest{MetricName: "req", TagValues: []string{"web", "/a:b"}, Step: TimestepHour, Fn: SumFn, NumSteps: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Values) != 1 || g.Values[0][1] != 1 {
+		t.Errorf("web /a:b graphs as %v, want 1", g.Values)
+	}
+
+	// nothing left to move
+	report, err = c.MigrateKeys(MigrateKeysRequest{MetricName: "req", Split: split})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Moved) != 0 {
+		t.Errorf("second migration moved %v", report.Moved)
+	}
+}
@@ -0,0 +1,383 @@
+package tophat
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is where a client and MemoryStorage get the current time,
+// so tests can write and graph at whatever time they like
+type Clock interface {
+	Now() time.Time
+}
+
+type system_clock struct{}
+
+func (system_clock) Now() time.Time { return time.Now() }
+
+// a Clock that only moves when told to
+type ManualClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func NewManualClock(t time.Time) *ManualClock {
+	return &ManualClock{t: t}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *ManualClock) Set(t time.Time) {
+	c.mu.Lock()
+	c.t = t
+	c.mu.Unlock()
+}
+
+func (c *ManualClock) Add(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	c.mu.Unlock()
+}
+
+// MemoryStorage keeps period hashes in process with the same semantics as the
+// redis scripts, for tests and embedding. keys expire by the clock the same as
+// expireat, once the clock reaches their expiry they are gone
+type MemoryStorage struct {
+	clock Clock
+
+	mu     sync.Mutex
+	hashes map[string]*memory_hash
+	sets   map[string]*memory_set
+	values map[string][]byte
+}
+
+type memory_hash struct {
+	fields    map[int]AggregateHashData
+	expire_at int64 // 0 for never
+}
+
+type memory_set struct {
+	members   map[string]bool
+	expire_at int64
+}
+
+func NewMemoryStorage(clock Clock) *MemoryStorage {
+	// a nil clock uses the system time
+	if clock == nil {
+		clock = system_clock{}
+	}
+	return &MemoryStorage{
+		clock:  clock,
+		hashes: map[string]*memory_hash{},
+		sets:   map[string]*memory_set{},
+		values: map[string][]byte{},
+	}
+}
+
+func NewMemoryClient(clock Clock) (*Client, error) {
+	// a client on a fresh MemoryStorage, with both using clock
+	client, err := NewStorageClient(NewMemoryStorage(clock))
+	if err != nil {
+		return nil, err
+	}
+	if clock != nil {
+		client.SetClock(clock)
+	}
+	return client, nil
+}
+
+func (s *MemoryStorage) hash(key string, create bool, expire_at int64) *memory_hash {
+	// the live hash for key, expired ones are dropped as they are found
+	// must hold s.mu
+	h, exists := s.hashes[key]
+	if exists && h.expire_at > 0 && h.expire_at <= s.clock.Now().Unix() {
+		delete(s.hashes, key)
+		exists = false
+	}
+	if !exists {
+		if !create {
+			return nil
+		}
+		h = &memory_hash{fields: map[int]AggregateHashData{}, expire_at: expire_at}
+		s.hashes[key] = h
+	}
+	return h
+}
+
+func (s *MemoryStorage) Aggregate(writes []AggregateWrite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, w := range writes {
+		h := s.hash(w.Key, true, w.ExpireAt)
+		h.fields[w.Field] = h.fields[w.Field].Merge(AggregateHashData{Count: 1, Sum: w.Value, Min: w.Value, Max: w.Value})
+	}
+	return nil
+}
+
+func (s *MemoryStorage) Fetch(key string) (map[int]AggregateHashData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fields := map[int]AggregateHashData{}
+	if h := s.hash(key, false, 0); h != nil {
+		for offset, data := range h.fields {
+			fields[offset] = data
+		}
+	}
+	return fields, nil
+}
+
+func (s *MemoryStorage) Set(key string, fields map[int]AggregateHashData, expire_at int64) error {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.hash(key, true, expire_at)
+	for offset, data := range fields {
+		h.fields[offset] = data
+	}
+	return nil
+}
+
+func (s *MemoryStorage) Merge(key string, fields map[int]AggregateHashData, expire_at int64) error {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.hash(key, true, expire_at)
+	for offset, data := range fields {
+		h.fields[offset] = h.fields[offset].Merge(data)
+	}
+	return nil
+}
+
+func (s *MemoryStorage) Move(src, dst string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	from := s.hash(src, false, 0)
+	if from == nil {
+		return false, nil
+	}
+	delete(s.hashes, src)
+
+	h := s.hash(dst, true, from.expire_at)
+	for offset, data := range from.fields {
+		h.fields[offset] = h.fields[offset].Merge(data)
+	}
+	return true, nil
+}
+
+func (s *MemoryStorage) ExpireAt(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if h := s.hash(key, false, 0); h != nil {
+		return h.expire_at, nil
+	}
+	return 0, nil
+}
+
+func (s *MemoryStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.hashes, key)
+	delete(s.sets, key)
+	delete(s.values, key)
+	return nil
+}
+
+func (s *MemoryStorage) DeleteFields(key string, fields []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.hash(key, false, 0)
+	if h == nil {
+		return nil
+	}
+	for _, f := range fields {
+		delete(h.fields, f)
+	}
+	// like redis a hash with no fields left is gone
+	if len(h.fields) == 0 {
+		delete(s.hashes, key)
+	}
+	return nil
+}
+
+func (s *MemoryStorage) set(key string) *memory_set {
+	// the live set for key, must hold s.mu
+	set, exists := s.sets[key]
+	if exists && set.expire_at > 0 && set.expire_at <= s.clock.Now().Unix() {
+		delete(s.sets, key)
+		return nil
+	}
+	return set
+}
+
+func (s *MemoryStorage) AddLimited(key, member string, limit int, expire_at int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set := s.set(key)
+	if set == nil {
+		set = &memory_set{members: map[string]bool{}, expire_at: expire_at}
+		s.sets[key] = set
+	}
+	if set.members[member] {
+		return true, nil
+	}
+	if len(set.members) >= limit {
+		return false, nil
+	}
+	set.members[member] = true
+	return true, nil
+}
+
+func (s *MemoryStorage) Scan(match string, fn func(key string) error) error {
+	// matching keys are collected first so fn can write or delete
+	s.mu.Lock()
+	keys := []string{}
+	for key := range s.hashes {
+		if s.hash(key, false, 0) != nil && glob_match(match, key) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range s.sets {
+		if s.set(key) != nil && glob_match(match, key) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range s.values {
+		if glob_match(match, key) {
+			keys = append(keys, key)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, exists := s.values[key]
+	if !exists {
+		return nil, nil
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (s *MemoryStorage) Put(key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.values[key] = append([]byte{}, value...)
+	return nil
+}
+
+func glob_match(pattern, s string) bool {
+	// redis match patterns: * ? [abc] [^abc] [a-z] and \ to escape, following
+	// redis' stringmatchlen down to its edge cases so Scan finds what SCAN MATCH would
+	for len(pattern) > 0 && len(s) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for ; len(s) > 0; s = s[1:] {
+				if glob_match(pattern[1:], s) {
+					return true
+				}
+			}
+			return false
+		case '?':
+		case '[':
+			end, match := glob_class(pattern, s[0])
+			if !match {
+				return false
+			}
+			pattern = pattern[end:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if pattern[0] != s[0] {
+				return false
+			}
+		}
+
+		pattern, s = pattern[1:], s[1:]
+		if len(s) == 0 {
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+		}
+	}
+	return len(pattern) == 0 && len(s) == 0
+}
+
+func glob_class(pattern string, c byte) (int, bool) {
+	// match c against the class opening pattern, returns the index of the
+	// closing ] and whether it matched. like redis a class without a ] runs
+	// to the end of the pattern and a range can end in ]
+	i := 1
+	negate := i < len(pattern) && pattern[i] == '^'
+	if negate {
+		i++
+	}
+
+	match := false
+	for {
+		if i >= len(pattern) {
+			i--
+			break
+		}
+		if pattern[i] == '\\' && len(pattern)-i >= 2 {
+			i++
+			if pattern[i] == c {
+				match = true
+			}
+		} else if pattern[i] == ']' {
+			break
+		} else if len(pattern)-i >= 3 && pattern[i+1] == '-' {
+			lo, hi := pattern[i], pattern[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			i += 2
+			if c >= lo && c <= hi {
+				match = true
+			}
+		} else if pattern[i] == c {
+			match = true
+		}
+		i++
+	}
+	return i, match != negate
+}
@@ -0,0 +1,257 @@
+package tophat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryAggregate(t *testing.T) {
+	// each write is counted, summed and min/maxed into its field like aggregate.lua
+	s := NewMemoryStorage(NewManualClock(time.Unix(1000, 0)))
+
+	writes := []AggregateWrite{
+		{Key: "k", Field: 1, Value: 3, ExpireAt: 2000},
+		{Key: "k", Field: 1, Value: -1, ExpireAt: 2000},
+		{Key: "k", Field: 1, Value: 7, ExpireAt: 2000},
+		{Key: "k", Field: 2, Value: 0.5, ExpireAt: 2000},
+	}
+	if err := s.Aggregate(writes); err != nil {
+		t.Fatal(err)
+	}
+
+	fields, err := s.Fetch("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]AggregateHashData{
+		1: {Count: 3, Sum: 9, Min: -1, Max: 7},
+		2: {Count: 1, Sum: 0.5, Min: 0.5, Max: 0.5},
+	}
+	if len(fields) != len(want) {
+		t.Fatalf("got %d fields, want %d", len(fields), len(want))
+	}
+	for f, w := range want {
+		if fields[f] != w {
+			t.Errorf("field %d: got %+v, want %+v", f, fields[f], w)
+		}
+	}
+}
+
+func TestMemoryMerge(t *testing.T) {
+	// merged aggregates add counts and sums and widen min/max like AggregateMergeInto
+	s := NewMemoryStorage(NewManualClock(time.Unix(1000, 0)))
+
+	if err := s.Aggregate([]AggregateWrite{
+		{Key: "k", Field: 1, Value: 3, ExpireAt: 2000},
+		{Key: "k", Field: 1, Value: 5, ExpireAt: 2000},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	err := s.Merge("k", map[int]AggregateHashData{
+		1: {Count: 2, Sum: 10, Min: 1, Max: 9},
+		2: {Count: 4, Sum: 8, Min: 2, Max: 2},
+	}, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields, err := s.Fetch("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		field int
+		want  AggregateHashData
+	}{
+		{1, AggregateHashData{Count: 4, Sum: 18, Min: 1, Max: 9}},
+		{2, AggregateHashData{Count: 4, Sum: 8, Min: 2, Max: 2}},
+	}
+	for _, tt := range tests {
+		if fields[tt.field] != tt.want {
+			t.Errorf("field %d: got %+v, want %+v", tt.field, fields[tt.field], tt.want)
+		}
+	}
+}
+
+func TestMemoryExpiry(t *testing.T) {
+	// like the scripts expireat is only set when a write creates the key
+	clock := NewManualClock(time.Unix(1000, 0))
+	s := NewMemoryStorage(clock)
+	one := map[int]AggregateHashData{1: {Count: 1, Sum: 1, Min: 1, Max: 1}}
+
+	expire_at := func(key string, want int64) {
+		t.Helper()
+		got, err := s.ExpireAt(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s expires at %d, want %d", key, got, want)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		write func(key string, expire int64) error
+	}{
+		{"aggregate", func(key string, expire int64) error {
+			return s.Aggregate([]AggregateWrite{{Key: key, Field: 1, Value: 1, ExpireAt: expire}})
+		}},
+		{"merge", func(key string, expire int64) error {
+			return s.Merge(key, one, expire)
+		}},
+		{"set", func(key string, expire int64) error {
+			return s.Set(key, one, expire)
+		}},
+	}
+
+	for _, tt := range tests {
+		clock.Set(time.Unix(1000, 0))
+		if err := tt.write(tt.name, 1500); err != nil {
+			t.Fatal(err)
+		}
+		if err := tt.write(tt.name, 1800); err != nil {
+			t.Fatal(err)
+		}
+		expire_at(tt.name, 1500)
+
+		// gone once the clock gets there, the next write creates it again
+		clock.Set(time.Unix(1500, 0))
+		fields, err := s.Fetch(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fields) != 0 {
+			t.Errorf("%s: expired key still has %d fields", tt.name, len(fields))
+		}
+		expire_at(tt.name, 0)
+
+		if err := tt.write(tt.name, 1900); err != nil {
+			t.Fatal(err)
+		}
+		expire_at(tt.name, 1900)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	// results are what redis' SCAN MATCH gives for the same pattern and key
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "anything", true},
+		{"*", "", false},
+		{"", "", true},
+		{"a*", "a", true},
+		{"a**", "abc", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbb", false},
+		{"a*?", "a", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`h[\]]llo`, "h]llo", true},
+		{`\`, `\`, true},
+		{`a\`, `a\`, true},
+
+		// a class without a ] runs to the end of the pattern
+		{"a[bc", "ab", true},
+		{"a[bc", "ac", true},
+		{"a[bc", "a[bc", false},
+		{"a[", "a[", false},
+		{"a[^", "ax", true},
+
+		// a range can end on the ] that would have closed the class
+		{"[a-]x", "bx", false},
+		{"[a-]x", "^", true},
+		{"[a-]x]", "^", true},
+		{"[a-]x]", "x", true},
+		{"[a-]x]", "^x", false},
+
+		// the patterns filter_match makes
+		{`m:*:\*:*:h`, "m:a:*:1:h", true},
+		{`m:*:\*:*:h`, "m:a:b:1:h", false},
+		{`{m:*}:*:d`, "{m:a}:100:d", true},
+	}
+
+	for _, tt := range tests {
+		if got := glob_match(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("glob_match(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryGraphPeriodBoundary(t *testing.T) {
+	// a graph across the hour reads the end of the previous period and the start of this one
+	clock := NewManualClock(time.Date(2024, 3, 1, 10, 58, 0, 0, time.UTC))
+	c, err := NewMemoryClient(clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.AddMetric(&Metric{Name: "hits", Key: "hits", Tags: []string{"page"}, Steps: []*Timestep{TimestepHour}, Type: DefaultMetric})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(v float64) {
+		t.Helper()
+		if err := c.Write(MetricValue{MetricName: "hits", TagValues: []string{"home"}, Timestamp: clock.Now(), ValueFloat: v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(1)
+	write(2)
+	clock.Add(time.Minute)
+	write(4)
+	clock.Add(2 * time.Minute)
+	write(8)
+
+	g, err := c.Graph(MetricGraphRequest{MetricName: "hits", TagValues: []string{"home"}, Step: TimestepHour, Fn: SumFn, NumSteps: 4, Fill: ZeroFill})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2024, 3, 1, 10, 58, 0, 0, time.UTC).Unix()
+	want := [][2]float64{
+		{float64(start), 3},
+		{float64(start + 60), 4},
+		{float64(start + 120), 0},
+		{float64(start + 180), 8},
+	}
+	if len(g.Values) != len(want) {
+		t.Fatalf("got %v, want %v", g.Values, want)
+	}
+	for i, v := range want {
+		if g.Values[i] != v {
+			t.Errorf("step %d: got %v, want %v", i, g.Values[i], v)
+		}
+	}
+
+	// still there at the end of the next hour, the default keeps 2 periods
+	clock.Set(time.Date(2024, 3, 1, 11, 59, 0, 0, time.UTC))
+	g, err = c.Graph(MetricGraphRequest{MetricName: "hits", TagValues: []string{"home"}, Step: TimestepHour, Fn: SumFn, NumSteps: 62})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Values) != 3 || g.Values[0] != [2]float64{float64(start), 3} {
+		t.Errorf("got %v, want the three steps written", g.Values)
+	}
+
+	// then the 10:00 period expires with the hour after it
+	clock.Set(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	g, err = c.Graph(MetricGraphRequest{MetricName: "hits", TagValues: []string{"home"}, Step: TimestepHour, Fn: SumFn, NumSteps: 63})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Values) != 1 || g.Values[0] != [2]float64{float64(start + 180), 8} {
+		t.Errorf("got %v, want only the step written at 11:01", g.Values)
+	}
+}
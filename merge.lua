@@ -0,0 +1,43 @@
+-- expects 2 keys: source, destination
+-- merges every packed count,sum,min,max in source into destination, then deletes source
+-- destination keeps its expiry, or takes the source's if it didn't exist
+-- once source is gone running it again does nothing
+
+-- cache lookups as locals
+local rcall = redis.call
+local src = KEYS[1]
+local dst = KEYS[2]
+
+if rcall('exists', src) == 0 then
+	return 0
+end
+
+local pttl = rcall('pttl', src)
+local dst_exists = rcall('exists', dst)
+
+local data = rcall('hgetall', src)
+for i = 1, #data, 2 do
+	local hash_key = data[i]
+	local count, sum, min, max = struct.unpack('<Iddd', data[i+1])
+
+	local existing = rcall('hget', dst, hash_key)
+	if existing then
+		local dcount, dsum, dmin, dmax = struct.unpack('<Iddd', existing)
+		count = count + dcount
+		sum = sum + dsum
+
+		-- if are way faster than math.min
+		if dmin < min then min = dmin end
+		if dmax > max then max = dmax end
+	end
+
+	rcall('hset', dst, hash_key, struct.pack('<Iddd', count, sum, min, max))
+end
+
+if dst_exists == 0 and pttl > 0 then
+	rcall('pexpire', dst, pttl)
+end
+
+rcall('del', src)
+
+return 1
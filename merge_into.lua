@@ -0,0 +1,35 @@
+-- expects 1 key and 1 + 2n args: expire_time, then hash_key, packed value pairs
+-- the destination half of AggregateMerge for when the source is in another slot or shard
+-- merges the values read from the source, destination keeps its expiry
+-- or takes expire_time if it didn't exist
+
+-- cache lookups as locals
+local rcall = redis.call
+local dst = KEYS[1]
+local ttl = tonumber(ARGV[1])
+
+local dst_exists = rcall('exists', dst)
+
+for i = 2, #ARGV, 2 do
+	local hash_key = ARGV[i]
+	local count, sum, min, max = struct.unpack('<Iddd', ARGV[i+1])
+
+	local existing = rcall('hget', dst, hash_key)
+	if existing then
+		local dcount, dsum, dmin, dmax = struct.unpack('<Iddd', existing)
+		count = count + dcount
+		sum = sum + dsum
+
+		-- if are way faster than math.min
+		if dmin < min then min = dmin end
+		if dmax > max then max = dmax end
+	end
+
+	rcall('hset', dst, hash_key, struct.pack('<Iddd', count, sum, min, max))
+end
+
+if dst_exists == 0 and ttl > 0 then
+	rcall('expireat', dst, ttl)
+end
+
+return 1
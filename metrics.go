@@ -15,8 +15,9 @@ type MetricType struct {
 	Script *redis.Script
 }
 
+// the script RedisStorage aggregates with, other types aren't supported yet
 var DefaultMetric = MetricType{
-	Script: redis.NewScript(1, AggregateHash),
+	Script: aggregate_hash_script,
 }
 
 const SEP = ":"
@@ -27,8 +28,34 @@ type Metric struct {
 	Tags  []string
 	Steps []*Timestep
 	Type  MetricType
+
+	// opt in to timesteps with per-second steps such as TimestepMinute
+	HighResolution bool
+
+	// only write the first (finest) timestep, the rest are filled in by Client.Rollup
+	// coarse graphs then lag by up to a period of the first timestep
+	Rollup bool
+
+	// optional retention per timestep name, overriding Timestep.Keep for this metric
+	Keep map[string]int
+
+	// how redis keys are laid out, ClusterKeyLayout is required on a cluster client
+	Layout KeyLayout
+
+	// optional checks on tag values and the number of series, see TagRules
+	Rules *TagRules
 }
 
+type KeyLayout int
+
+const (
+	// key:tagv1:tagv2:timestamp:stepkey
+	DefaultKeyLayout KeyLayout = iota
+	// {key:tagv1:tagv2}:timestamp:stepkey, the braces are a redis cluster hash tag
+	// so every period of a series hashes to the same slot
+	ClusterKeyLayout
+)
+
 type MetricValue struct {
 	MetricName string
 	TagValues  []string
@@ -46,18 +73,60 @@ const (
 	AvgFn
 )
 
+var fn_names = map[MetricFn]string{
+	CountFn: "count",
+	SumFn:   "sum",
+	MinFn:   "min",
+	MaxFn:   "max",
+	AvgFn:   "avg",
+}
+
+func (fn MetricFn) String() string {
+	if name, exists := fn_names[fn]; exists {
+		return name
+	}
+	return "unknown"
+}
+
+func ParseMetricFn(name string) (MetricFn, error) {
+	for fn, n := range fn_names {
+		if n == name {
+			return fn, nil
+		}
+	}
+	return 0, errors.New("Unknown metric function: " + name)
+}
+
 type MetricGraphRequest struct {
 	MetricName string
 	TagValues  []string
 	Step       *Timestep
 	Fn         MetricFn
-	FillZero   bool
-	NumSteps   int // optional to override Timestep defined steps
+	Fill       FillMode // what to do with steps that have no data, NoFill leaves them out
+	FillZero   bool     // the same as Fill: ZeroFill, from before there were fill modes
+	NumSteps   int      // optional to override Timestep defined steps
+
+	// optional, also graph the same window this long ago, e.g. 24h for the same hours yesterday
+	// graphs read the period an offset lands in and the one before, both have to still be kept
+	// so an offset can go back Keep - 2 periods, e.g. on the day timestep 24h needs a Keep
+	// of 3 and 168h a Keep of 9. longer offsets are an error
+	Offsets []time.Duration
+
+	// optional, applied in order to the values and any shifted values
+	Transforms []Transform
 }
 
 type MetricGraph struct {
-	Tags   map[string]string `json:"tags"`
-	Values [][2]float64      `json:"values"`
+	Tags    map[string]string `json:"tags"`
+	Values  GraphValues       `json:"values"`
+	Shifted []*ShiftedGraph   `json:"shifted,omitempty"` // one per requested offset, in order
+}
+
+// the window an offset back, with timestamps moved onto the current window's steps
+type ShiftedGraph struct {
+	Offset time.Duration `json:"offset"` // nanoseconds in json, like any time.Duration
+	Values GraphValues   `json:"values"`
+	Change GraphValues   `json:"change"` // percent change from these values to the current ones
 }
 
 func (mg *MetricGraph) Spark() []float64 {
@@ -77,11 +146,41 @@ func (mg *MetricGraph) SparkString() string {
 	return s
 }
 
-func write_key(key string, mv MetricValue, t *Timestep, previous bool) string {
+func (mg *MetricGraph) Label() string {
+	// tags as k=v in a stable order, used for legends and headers
+	keys := make([]string, 0, len(mg.Tags))
+	for k := range mg.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+mg.Tags[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *Metric) series_key(tag_values []string) string {
+	// the part of a key shared by every period of a series
+	// tag values are escaped so they can't be mistaken for separators
+	escaped := make([]string, len(tag_values))
+	for i, v := range tag_values {
+		escaped[i] = escape_tag(v)
+	}
+
+	k := m.Key + SEP + strings.Join(escaped, SEP)
+	if m.Layout == ClusterKeyLayout {
+		k = "{" + k + "}"
+	}
+	return k
+}
+
+func (m *Metric) write_key(mv MetricValue, t *Timestep, previous bool) string {
 	// make a key for redis that looks like
 	// key:tagv1:tagv2:tagvX:timestamp:stepkey
 	// where timestamp is start of the specified period
-	k := key + SEP + strings.Join(mv.TagValues, SEP) + SEP
+	k := m.series_key(mv.TagValues) + SEP
 	if previous {
 		k += strconv.FormatInt(t.StartOfPreviousPeriod(mv.Timestamp), 10)
 	} else {
@@ -91,7 +190,125 @@ func write_key(key string, mv MetricValue, t *Timestep, previous bool) string {
 	return k
 }
 
-func (m *Metric) WriteFloat(conn redis.Conn, mv MetricValue) error {
+func (m *Metric) parse_key(key string) (tag_values []string, start int64, step_key string, ok bool) {
+	// undo write_key, skipping anything that wasn't written for this metric
+	parts, ok := m.key_parts(key)
+	if !ok || len(parts) != len(m.Tags)+2 {
+		return nil, 0, "", false
+	}
+
+	start, step_key, ok = m.key_period(parts)
+	if !ok {
+		return nil, 0, "", false
+	}
+
+	tag_values = make([]string, len(m.Tags))
+	for i, raw := range parts[:len(m.Tags)] {
+		if tag_values[i], ok = unescape_tag(raw); !ok {
+			return nil, 0, "", false
+		}
+	}
+
+	return tag_values, start, step_key, true
+}
+
+func (m *Metric) key_parts(key string) ([]string, bool) {
+	// the SEP separated parts of a key after the metric key, tag values still escaped
+	prefix := m.Key + SEP
+	if m.Layout == ClusterKeyLayout {
+		prefix = "{" + prefix
+	}
+	if !strings.HasPrefix(key, prefix) {
+		return nil, false
+	}
+
+	rest := key[len(prefix):]
+	if m.Layout == ClusterKeyLayout {
+		// the hash tag closes before the timestamp and step key
+		i := strings.LastIndex(rest, "}"+SEP)
+		if i == -1 {
+			return nil, false
+		}
+		rest = rest[:i] + rest[i+1:]
+	}
+
+	// a metric without tags still has the separator after its key, key::timestamp:stepkey
+	if len(m.Tags) == 0 {
+		if !strings.HasPrefix(rest, SEP) {
+			return nil, false
+		}
+		rest = rest[len(SEP):]
+	}
+
+	return strings.Split(rest, SEP), true
+}
+
+func (m *Metric) key_period(parts []string) (start int64, step_key string, ok bool) {
+	// the period start and step key from the end of a key's parts
+	if len(parts) < 2 {
+		return 0, "", false
+	}
+
+	start, err := strconv.ParseInt(parts[len(parts)-2], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+
+	step_key = parts[len(parts)-1]
+	for _, step := range m.Steps {
+		if step.Key == step_key {
+			return start, step_key, true
+		}
+	}
+
+	return 0, "", false
+}
+
+func (m *Metric) keep(step *Timestep) int {
+	if keep, exists := m.Keep[step.Name]; exists {
+		return keep
+	}
+	return step.Keep
+}
+
+func (m *Metric) PeriodExpireAt(step *Timestep, ts time.Time) int64 {
+	// the timestep's expiry with this metric's retention
+	return step.periods_after(step.StartOfPeriod(ts), m.keep(step))
+}
+
+func (m *Metric) check_offsets(step *Timestep, offsets []time.Duration, now time.Time) error {
+	// a shifted graph reads the previous period from then, it has to still be kept
+	for _, offset := range offsets {
+		previous := step.StartOfPreviousPeriod(now.Add(-offset))
+		if step.periods_after(previous, m.keep(step)) <= now.Unix() {
+			return errors.New("Graph offset " + offset.String() + " goes back further than the " +
+				strconv.Itoa(m.keep(step)) + " periods of " + step.Name + " kept for metric " + m.Name + ".")
+		}
+	}
+	return nil
+}
+
+func (m *Metric) Warnings() []string {
+	// Graph reads the current and previous periods, so anything kept for
+	// less than 2 periods will graph with holes
+	warnings := []string{}
+	for _, step := range m.Steps {
+		if keep := m.keep(step); keep < 2 {
+			warnings = append(warnings, "Metric "+m.Name+" keeps "+strconv.Itoa(keep)+" period(s) of "+step.Name+", graphs read 2.")
+		}
+	}
+	return warnings
+}
+
+func (m *Metric) write_steps() []*Timestep {
+	// timesteps written on every value, with rollups just the finest
+	if m.Rollup {
+		return m.Steps[:1]
+	}
+	return m.Steps
+}
+
+func (m *Metric) WriteFloat(store Storage, mv MetricValue) error {
 	// use the aggregation lua function to store data in a hashmap
 	// keys for the redis hashmap are the incremental offsets from the lower period of the timestep
 	// impression:1234:1427346000:h
@@ -101,119 +318,128 @@ func (m *Metric) WriteFloat(conn redis.Conn, mv MetricValue) error {
 	// each hashmap value holds a packed binary string containing count,sum,min,max
 
 	// do a write for every timestep
-	for _, step := range m.Steps {
-		redis_key := write_key(m.Key, mv, step, false)
-		hash_key := step.PeriodStep(mv.Timestamp)
-		expires := step.PeriodExpireAt(mv.Timestamp)
+	steps := m.write_steps()
+	writes := make([]AggregateWrite, 0, len(steps))
+	for _, step := range steps {
+		writes = append(writes, AggregateWrite{
+			Key:      m.write_key(mv, step, false),
+			Field:    step.PeriodStep(mv.Timestamp),
+			Value:    mv.ValueFloat,
+			ExpireAt: m.PeriodExpireAt(step, mv.Timestamp),
+		})
+	}
+	return store.Aggregate(writes)
+}
 
-		_, err := m.Type.Script.Do(conn, redis_key, hash_key, expires, mv.ValueFloat)
+func (m *Metric) Graph(store Storage, mgr MetricGraphRequest) (*MetricGraph, error) {
+	return m.graph(store, mgr, time.Now())
+}
+
+func (m *Metric) graph(store Storage, mgr MetricGraphRequest, now time.Time) (*MetricGraph, error) {
+	points := func(now time.Time) ([]int64, map[float64]float64, error) {
+		list, data, err := m.graph_data(store, mgr, now)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 
-		//fmt.Println(redis_key, hash_key, expires, mv.ValueFloat)
+		// build a map for timestamp => picked value
+		unpacked := make(map[float64]float64, len(data))
+		for timestamp, d := range data {
+			unpacked[timestamp] = AggregateHashPick(d, mgr.Fn)
+		}
+		return list, unpacked, nil
 	}
-	return nil
+
+	return graph_window(m.tag_map(mgr.TagValues), mgr, now, points)
 }
 
-func (m *Metric) Graph(conn redis.Conn, mgr MetricGraphRequest) (*MetricGraph, error) {
-	// fetch the write_keys for current period and the previous
+func graph_window(tags map[string]string, mgr MetricGraphRequest, now time.Time, points func(now time.Time) ([]int64, map[float64]float64, error)) (*MetricGraph, error) {
 	// return collection of points from now going back the step count defined in Timestep
-	// redis keys return hashmaps, with each value a packed binary string, we need to unpack
-	now := time.Now().UTC()
-	pkey := write_key(m.Key, MetricValue{Timestamp: now, TagValues: mgr.TagValues}, mgr.Step, true)
-	pts := mgr.Step.StartOfPreviousPeriod(now)
-	key := write_key(m.Key, MetricValue{Timestamp: now, TagValues: mgr.TagValues}, mgr.Step, false)
-	ts := mgr.Step.StartOfPeriod(now)
-
-	pres, err := ByteMap(conn.Do("hgetall", pkey))
-	if err != nil {
-		return nil, errors.New("Failed fetching previous key for graph (" + pkey + ") " + err.Error())
-	}
-	res, err := ByteMap(conn.Do("hgetall", key))
+	// plus the same window shifted back by each offset, lined up onto the current one
+	// points gives the steps to show for a window ending at now and their values
+	list, unpacked, err := points(now)
 	if err != nil {
-		return nil, errors.New("Failed fetching key for graph (" + pkey + ") " + err.Error())
+		return nil, err
 	}
 
-	// build a map for timestamp => {unpacked struct}
-	unpacked := make(map[float64]float64, len(pres)+len(res))
-	keys := make([]float64, 0, len(pres)+len(res))
+	result := &MetricGraph{
+		Tags:   tags,
+		Values: graph_values(list, unpacked, mgr.fill_mode()),
+	}
 
-	for k, v := range pres {
-		offset, _ := strconv.Atoi(k)
-		timestamp := float64(remake_timestamp(pts, offset, mgr.Step.Period))
-		data, err := AggregateHashUnpack(v)
+	for _, offset := range mgr.Offsets {
+		shifted_list, shifted, err := points(now.Add(-offset))
 		if err != nil {
 			return nil, err
 		}
-		unpacked[timestamp] = AggregateHashPick(data, mgr.Fn)
-		keys = append(keys, timestamp)
-	}
 
-	for k, v := range res {
-		offset, _ := strconv.Atoi(k)
-		timestamp := float64(remake_timestamp(ts, offset, mgr.Step.Period))
-		data, err := AggregateHashUnpack(v)
-		if err != nil {
-			return nil, err
+		// line the steps up by position rather than adding the offset back, so a
+		// 24h offset still lands on the same hour across daylight saving changes
+		aligned := make(map[float64]float64, len(shifted))
+		for i, timestamp := range shifted_list {
+			if val, exists := shifted[float64(timestamp)]; exists && i < len(list) {
+				aligned[float64(list[i])] = val
+			}
 		}
-		unpacked[timestamp] = AggregateHashPick(data, mgr.Fn)
-		keys = append(keys, timestamp)
-	}
 
-	sort.Float64s(keys)
+		// percentage change only where both sides have a step
+		values := graph_values(list, aligned, mgr.fill_mode())
+		result.Shifted = append(result.Shifted, &ShiftedGraph{
+			Offset: offset,
+			Values: values,
+			Change: percent_change(result.Values, values),
+		})
+	}
 
-	// determine how many steps we need
-	num_steps := mgr.Step.NumSteps
-	if mgr.NumSteps > 0 {
-		num_steps = mgr.NumSteps
+	if err := result.Transform(mgr.Step, mgr.Transforms...); err != nil {
+		return nil, err
 	}
 
-	// now we can actually assemble the sorted array of arrays
-	values := make([][2]float64, 0, num_steps)
+	return result, nil
+}
+
+func (m *Metric) graph_data(store Storage, mgr MetricGraphRequest, now time.Time) ([]int64, map[float64]AggregateHashData, error) {
+	// fetch the write_keys for current period and the previous
+	// stored hashes are keyed by step offset, each holding count,sum,min,max
+	// returns the steps to show and a map for timestamp => step data
+	now = now.UTC()
+	pkey := m.write_key(MetricValue{Timestamp: now, TagValues: mgr.TagValues}, mgr.Step, true)
+	pts := mgr.Step.StartOfPreviousPeriod(now)
+	key := m.write_key(MetricValue{Timestamp: now, TagValues: mgr.TagValues}, mgr.Step, false)
+	ts := mgr.Step.StartOfPeriod(now)
 
-	// get the list of steps we need to return
-	list := mgr.Step.PeriodStepList(now, num_steps)
+	pres, err := store.Fetch(pkey)
+	if err != nil {
+		return nil, nil, errors.New("Failed fetching previous key for graph (" + pkey + ") " + err.Error())
+	}
+	res, err := store.Fetch(key)
+	if err != nil {
+		return nil, nil, errors.New("Failed fetching key for graph (" + pkey + ") " + err.Error())
+	}
 
-	// construct the result, optionally fill empty steps
-	for _, timestamp := range list {
-		t := float64(timestamp)
-		val, exists := unpacked[t]
-		if exists {
-			values = append(values, [2]float64{t, val})
-		} else if mgr.FillZero {
-			values = append(values, [2]float64{t, 0})
-		}
+	data := make(map[float64]AggregateHashData, len(pres)+len(res))
+
+	for offset, d := range pres {
+		data[float64(mgr.Step.remake_timestamp(pts, offset))] = d
 	}
 
-	result := &MetricGraph{
-		Tags:   m.tag_map(mgr.TagValues),
-		Values: values,
+	for offset, d := range res {
+		data[float64(mgr.Step.remake_timestamp(ts, offset))] = d
 	}
 
-	return result, nil
-}
+	// get the list of steps we need to return, NumSteps overrides the Timestep's
+	list := mgr.Step.PeriodStepList(now, mgr.NumSteps)
 
-func remake_timestamp(start int64, offset int, period Time) int64 {
-	// we want to add the amount of time for the period under the given
-	// so we a remaking an offset timestamp for a day graph, we add offset * seconds_in_hours\
-	// being careful that day and month offsets do not start at 0
-	end := time.Unix(start, 0).UTC()
+	return list, data, nil
+}
 
-	switch period {
-	case Minute:
-		end = end.Add(time.Duration(offset) * time.Second)
-	case Hour:
-		end = end.Add(time.Duration(offset) * time.Minute)
-	case Day:
-		end = end.Add(time.Duration(offset) * time.Hour)
-	case Month:
-		end = end.AddDate(0, 0, offset-1)
-	case Year:
-		end = end.AddDate(0, offset-1, 0)
+func (m *Metric) has_step(step *Timestep) bool {
+	for _, s := range m.Steps {
+		if step.Name == s.Name {
+			return true
+		}
 	}
-
-	return end.Unix()
+	return false
 }
 
 // lifted from the redis helper StringMap
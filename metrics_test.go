@@ -0,0 +1,180 @@
+package tophat
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMetricKeep(t *testing.T) {
+	// overrides change when a metric's keys expire and warn when graphs would have holes
+	ts := time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		keep     map[string]int
+		expires  []time.Time // hour then day
+		warnings []string
+		err      string
+	}{
+		{keep: nil, expires: []time.Time{ts.Truncate(time.Hour).Add(2 * time.Hour), time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC)}, warnings: []string{}},
+		{keep: map[string]int{"hour": 48}, expires: []time.Time{ts.Truncate(time.Hour).Add(48 * time.Hour), time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC)}, warnings: []string{}},
+		{keep: map[string]int{"hour": 1, "day": 1}, expires: []time.Time{ts.Truncate(time.Hour).Add(time.Hour), time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)},
+			warnings: []string{"Metric m keeps 1 period(s) of hour, graphs read 2.", "Metric m keeps 1 period(s) of day, graphs read 2."}},
+
+		{keep: map[string]int{"month": 3}, err: "Retention override for a timestep the metric doesn't use. (month)"},
+		{keep: map[string]int{"hour": 0}, err: "Retention override must keep at least 1 period. (hour)"},
+	}
+
+	for _, tt := range tests {
+		c, err := NewMemoryClient(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &Metric{Name: "m", Key: "m", Steps: []*Timestep{TimestepHour, TimestepDay}, Keep: tt.keep, Type: DefaultMetric}
+		err = c.AddMetric(m)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("keep %v: got error %v, want %q", tt.keep, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("keep %v: %v", tt.keep, err)
+			continue
+		}
+
+		for i, step := range m.Steps {
+			if got := m.PeriodExpireAt(step, ts); got != tt.expires[i].Unix() {
+				t.Errorf("keep %v: %s expires %s, want %s", tt.keep, step.Name, time.Unix(got, 0).UTC(), tt.expires[i])
+			}
+		}
+		if got := m.Warnings(); !reflect.DeepEqual(got, tt.warnings) {
+			t.Errorf("keep %v: warnings %q, want %q", tt.keep, got, tt.warnings)
+		}
+	}
+
+	// the override doesn't change the shared timestep
+	if TimestepHour.Keep != 2 {
+		t.Errorf("hour keeps %d periods", TimestepHour.Keep)
+	}
+}
+
+func TestImportExpired(t *testing.T) {
+	// each timestep is only written while the value's period is still kept
+	now := time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC)
+	c, err := NewMemoryClient(NewManualClock(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.AddMetric(&Metric{Name: "hits", Key: "hits", Tags: []string{"page"}, Steps: []*Timestep{TimestepHour, TimestepDay}, Type: DefaultMetric})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := []MetricValue{
+		{MetricName: "hits", TagValues: []string{"home"}, Timestamp: now.Add(-10 * time.Minute), ValueFloat: 1},
+		{MetricName: "hits", TagValues: []string{"home"}, Timestamp: now.Add(-150 * time.Minute), ValueFloat: 2}, // 08:00 expired from hour
+		{MetricName: "hits", TagValues: []string{"home"}, Timestamp: now.AddDate(0, 0, -2), ValueFloat: 4},       // expired from both
+		{MetricName: "hits", TagValues: []string{"home"}, Timestamp: now, ValueFloat: math.NaN()},
+		{MetricName: "nope", TagValues: []string{"home"}, Timestamp: now, ValueFloat: 1},
+	}
+	report, err := c.Import(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &ImportReport{
+		Written:      2,
+		StepsWritten: 3,
+		StepsExpired: 3,
+		Skipped: []ImportSkip{
+			{Index: 2, Reason: "Retention passed for every timestep (1709116200)"},
+			{Index: 3, Reason: "No value to write."},
+			{Index: 4, Reason: "No metric with name: nope"},
+		},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("got %+v, want %+v", report, want)
+	}
+
+	tests := []struct {
+		step *Timestep
+		want [][2]float64
+	}{
+		{TimestepHour, [][2]float64{{float64(now.Add(-10 * time.Minute).Unix()), 1}}},
+		{TimestepDay, [][2]float64{{float64(time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC).Unix()), 2}, {float64(time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC).Unix()), 1}}},
+	}
+	for _, tt := range tests {
+		g, err := c.Graph(MetricGraphRequest{MetricName: "hits", TagValues: []string{"home"}, Step: tt.step, Fn: SumFn, NumSteps: 60})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !same_values(g.Values, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.step.Name, g.Values, tt.want)
+		}
+	}
+}
+
+func TestGraphOffsets(t *testing.T) {
+	// a shifted graph reads the period its offset lands in and the one before,
+	// so offsets can only go back as far as both are kept
+	now := time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC)
+	c, err := NewMemoryClient(NewManualClock(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.AddMetric(&Metric{Name: "hits", Key: "hits", Tags: []string{"page"}, Steps: []*Timestep{TimestepHour, TimestepDay}, Keep: map[string]int{"day": 3}, Type: DefaultMetric})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddDerivedMetric(&DerivedMetric{Name: "mean", Expression: "hits.sum / hits.count"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Write(MetricValue{MetricName: "hits", TagValues: []string{"home"}, Timestamp: now.Add(-30 * time.Minute), ValueFloat: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		metric string
+		step   *Timestep
+		offset time.Duration
+		err    string
+	}{
+		{"hits", TimestepHour, 30 * time.Minute, ""},
+		{"hits", TimestepHour, 31 * time.Minute, "Graph offset 31m0s goes back further than the 2 periods of hour kept for metric hits."},
+		{"hits", TimestepDay, 24 * time.Hour, ""},
+		{"hits", TimestepDay, 48 * time.Hour, "Graph offset 48h0m0s goes back further than the 3 periods of day kept for metric hits."},
+		{"hits", TimestepHour, -time.Hour, "Graph offsets need to be positive, they go back in time."},
+
+		// derived metrics check each of their metrics
+		{"mean", TimestepHour, 30 * time.Minute, ""},
+		{"mean", TimestepHour, time.Hour, "Graph offset 1h0m0s goes back further than the 2 periods of hour kept for metric hits."},
+	}
+
+	for _, tt := range tests {
+		g, err := c.Graph(MetricGraphRequest{MetricName: tt.metric, TagValues: []string{"home"}, Step: tt.step, Fn: SumFn, NumSteps: 1, Offsets: []time.Duration{tt.offset}})
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s %s %s: got error %v, want %q", tt.metric, tt.step.Name, tt.offset, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s %s: %v", tt.metric, tt.step.Name, tt.offset, err)
+			continue
+		}
+		if len(g.Shifted) != 1 {
+			t.Errorf("%s %s %s: got %d shifted graphs", tt.metric, tt.step.Name, tt.offset, len(g.Shifted))
+		}
+	}
+
+	// 30m back lands on the 10:00 write, lined up with the 10:30 step
+	g, err := c.Graph(MetricGraphRequest{MetricName: "hits", TagValues: []string{"home"}, Step: TimestepHour, Fn: SumFn, NumSteps: 1, Offsets: []time.Duration{30 * time.Minute}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][2]float64{{float64(now.Unix()), 5}}; !same_values(g.Shifted[0].Values, want) {
+		t.Errorf("shifted 30m: got %v, want %v", g.Shifted[0].Values, want)
+	}
+}
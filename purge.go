@@ -0,0 +1,142 @@
+package tophat
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+type PurgeRequest struct {
+	MetricName string
+	Tags       map[string]string // only series with these tag values, empty for every series
+	From       time.Time         // only data from here, zero for the beginning
+	To         time.Time         // only data before here, zero for no end
+	DryRun     bool              // report what would be removed without removing it
+}
+
+type PurgeReport struct {
+	Keys   []string       // whole period keys removed
+	Fields map[string]int // key => hash fields removed, for periods partly in range
+}
+
+func (c *Client) Purge(pr PurgeRequest) (*PurgeReport, error) {
+	// remove data for a metric by tag values and time range
+	// periods entirely in the range are deleted, otherwise just the steps in range
+	m, exists := c.metrics[pr.MetricName]
+	if !exists {
+		return nil, errors.New("No metric with name: " + pr.MetricName)
+	}
+
+	// tag values in metric order, empty matches anything
+	filter := make([]string, len(m.Tags))
+	for tag, value := range pr.Tags {
+		index := -1
+		for i, t := range m.Tags {
+			if t == tag {
+				index = i
+			}
+		}
+		if index == -1 {
+			return nil, errors.New("No tag " + tag + " for metric: " + m.Name)
+		}
+		filter[index] = value
+	}
+
+	from := int64(0)
+	if !pr.From.IsZero() {
+		from = pr.From.Unix()
+	}
+	to := int64(-1)
+	if !pr.To.IsZero() {
+		to = pr.To.Unix()
+	}
+
+	report := &PurgeReport{Fields: map[string]int{}}
+
+	err := c.scan_keys(filter_match(m, filter, ""), func(store Storage, key string) error {
+		tag_values, start, step_key, ok := m.parse_key(key)
+		if !ok {
+			return nil
+		}
+		for i, v := range filter {
+			if v != "" && tag_values[i] != v {
+				return nil
+			}
+		}
+
+		var step *Timestep
+		for _, s := range m.Steps {
+			if s.Key == step_key {
+				step = s
+			}
+		}
+		end := step.end_of_period(start)
+
+		// entirely outside the range
+		if end <= from || (to != -1 && start >= to) {
+			return nil
+		}
+
+		// entirely inside the range
+		if start >= from && (to == -1 || end <= to) {
+			report.Keys = append(report.Keys, key)
+			if pr.DryRun {
+				return nil
+			}
+			return store.Delete(key)
+		}
+
+		// only part of the period is in range, find the steps that are
+		fields, err := store.Fetch(key)
+		if err != nil {
+			return err
+		}
+
+		remove := []int{}
+		for offset := range fields {
+			ts := step.remake_timestamp(start, offset)
+			if ts >= from && (to == -1 || ts < to) {
+				remove = append(remove, offset)
+			}
+		}
+		if len(remove) == 0 {
+			return nil
+		}
+
+		report.Fields[key] = len(remove)
+		if pr.DryRun {
+			return nil
+		}
+		return store.DeleteFields(key, remove)
+	})
+
+	return report, err
+}
+
+func filter_match(m *Metric, filter []string, step_key string) string {
+	// a scan pattern narrowed by whichever tag values are known
+	// and optionally to one timestep
+	parts := make([]string, len(filter))
+	for i, v := range filter {
+		if v == "" {
+			parts[i] = "*"
+		} else {
+			parts[i] = glob_escape(escape_tag(v))
+		}
+	}
+
+	match := glob_escape(m.Key) + SEP + strings.Join(parts, SEP)
+	if m.Layout == ClusterKeyLayout {
+		match = "{" + match + "}"
+	}
+	if step_key == "" {
+		return match + SEP + "*"
+	}
+	return match + SEP + "*" + SEP + glob_escape(step_key)
+}
+
+func glob_escape(s string) string {
+	// escape the characters redis match patterns treat specially
+	r := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+	return r.Replace(s)
+}
@@ -0,0 +1,123 @@
+package tophat
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestPurge(t *testing.T) {
+	at := func(h, m int) time.Time { return time.Date(2024, 3, 1, h, m, 0, 0, time.UTC) }
+
+	// home has writes in the 09:00 and 10:00 hours, about just in 10:00
+	purge_client := func() *Client {
+		clock := NewManualClock(at(10, 30))
+		c, err := NewMemoryClient(clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.AddMetric(&Metric{Name: "hits", Key: "hits", Tags: []string{"page", "app"}, Steps: []*Timestep{TimestepHour, TimestepDay}, Type: DefaultMetric})
+		if err != nil {
+			t.Fatal(err)
+		}
+		writes := []struct {
+			page string
+			ts   time.Time
+		}{
+			{"home", at(9, 10)}, {"home", at(9, 50)}, {"home", at(10, 5)}, {"home", at(10, 20)}, {"about", at(10, 5)},
+		}
+		for _, w := range writes {
+			if err := c.Write(MetricValue{MetricName: "hits", TagValues: []string{w.page, "web"}, Timestamp: w.ts, ValueFloat: 1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return c
+	}
+
+	// what's left as key => steps
+	left := func(c *Client) map[string][]int {
+		keys := map[string][]int{}
+		err := c.stores[0].Scan("hits:*", func(key string) error {
+			fields, err := c.stores[0].Fetch(key)
+			if err != nil {
+				return err
+			}
+			for f := range fields {
+				keys[key] = append(keys[key], f)
+			}
+			sort.Ints(keys[key])
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+
+	const (
+		home9   = "hits:home:web:1709283600:h"
+		home10  = "hits:home:web:1709287200:h"
+		home    = "hits:home:web:1709251200:d"
+		about   = "hits:about:web:1709251200:d"
+		about10 = "hits:about:web:1709287200:h"
+	)
+	all := map[string][]int{home9: {10, 50}, home10: {5, 20}, home: {9, 10}, about10: {5}, about: {10}}
+
+	tests := []struct {
+		name   string
+		pr     PurgeRequest
+		keys   []string
+		fields map[string]int
+		left   map[string][]int
+		err    string
+	}{
+		{name: "series", pr: PurgeRequest{Tags: map[string]string{"page": "home"}},
+			keys: []string{home, home9, home10}, fields: map[string]int{},
+			left: map[string][]int{about10: {5}, about: {10}}},
+
+		// hour keys inside the range go, day keys lose the steps that are
+		{name: "from", pr: PurgeRequest{From: at(10, 0)},
+			keys: []string{about10, home10}, fields: map[string]int{home: 1, about: 1},
+			left: map[string][]int{home9: {10, 50}, home: {9}}},
+		{name: "to", pr: PurgeRequest{To: at(10, 0)},
+			keys: []string{home9}, fields: map[string]int{home: 1},
+			left: map[string][]int{home10: {5, 20}, home: {10}, about10: {5}, about: {10}}},
+		{name: "range", pr: PurgeRequest{Tags: map[string]string{"page": "home", "app": "web"}, From: at(10, 0), To: at(10, 10)},
+			keys: nil, fields: map[string]int{home10: 1, home: 1},
+			left: map[string][]int{home9: {10, 50}, home10: {20}, home: {9}, about10: {5}, about: {10}}},
+		{name: "outside", pr: PurgeRequest{From: at(11, 0)},
+			keys: nil, fields: map[string]int{}, left: all},
+		{name: "dry run", pr: PurgeRequest{Tags: map[string]string{"page": "home"}, DryRun: true},
+			keys: []string{home, home9, home10}, fields: map[string]int{}, left: all},
+
+		{name: "unknown tag", pr: PurgeRequest{Tags: map[string]string{"nope": "x"}}, err: "No tag nope for metric: hits"},
+		{name: "unknown metric", pr: PurgeRequest{MetricName: "nope"}, err: "No metric with name: nope"},
+	}
+
+	for _, tt := range tests {
+		c := purge_client()
+		if tt.pr.MetricName == "" {
+			tt.pr.MetricName = "hits"
+		}
+		report, err := c.Purge(tt.pr)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		sort.Strings(report.Keys)
+		if !reflect.DeepEqual(report.Keys, tt.keys) || !reflect.DeepEqual(report.Fields, tt.fields) {
+			t.Errorf("%s: removed %q and %v, want %q and %v", tt.name, report.Keys, report.Fields, tt.keys, tt.fields)
+		}
+		if got := left(c); !reflect.DeepEqual(got, tt.left) {
+			t.Errorf("%s: left %v, want %v", tt.name, got, tt.left)
+		}
+	}
+}
@@ -0,0 +1,588 @@
+package tophat
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a query picks series of a metric by tag, optionally groups them and then
+// passes the graphs through pipes, top(n), bottom(n) or any Transform, e.g.
+//
+//	avg(latency{app="test",cid=*}) by (cid) | top(5) | movavg(3)
+//
+// tags are matched with ="value" or =* for any value, tags left out match any
+// value too. every series matched is merged into one graph, or one per value
+// of the by tags, merging the raw steps so avg, min and max stay exact.
+// fn defaults to count and is ignored for derived metrics, which can only be
+// grouped by every tag they match with =*
+type QueryRequest struct {
+	Query    string
+	Step     *Timestep
+	NumSteps int // optional to override Timestep defined steps
+	Fill     FillMode
+	FillZero bool // the same as Fill: ZeroFill
+}
+
+type query struct {
+	fn       MetricFn
+	metric   string
+	matchers map[string]string // tag => value, "*" for any
+	by       []string
+	pipes    []query_pipe
+}
+
+type query_pipe struct {
+	name string
+	args []float64
+}
+
+// pipes take every graph of the query so far and return the ones to pass on
+// any other pipe is a Transform by name, applied to each graph
+var query_pipes = map[string]func(graphs []*MetricGraph, args []float64) ([]*MetricGraph, error){
+	"top":    pipe_top,
+	"bottom": pipe_bottom,
+}
+
+func (c *Client) Query(qr QueryRequest) ([]*MetricGraph, error) {
+	q, err := parse_query(qr.Query)
+	if err != nil {
+		return nil, err
+	}
+	if qr.Step == nil {
+		return nil, errors.New("No timestep given.")
+	}
+
+	tags, exists := c.graph_tags(q.metric)
+	if !exists {
+		return nil, errors.New("No metric with name: " + q.metric)
+	}
+	index := map[string]int{}
+	for i, tag := range tags {
+		index[tag] = i
+	}
+	for tag := range q.matchers {
+		if _, exists := index[tag]; !exists {
+			return nil, errors.New("No tag " + tag + " for metric: " + q.metric)
+		}
+	}
+	for _, tag := range q.by {
+		if _, exists := index[tag]; !exists {
+			return nil, errors.New("No tag " + tag + " for metric: " + q.metric)
+		}
+		if v, given := q.matchers[tag]; given && v != "*" {
+			return nil, errors.New("Can't group by a tag matched to one value: " + tag)
+		}
+	}
+	for _, p := range q.pipes {
+		if _, exists := query_pipes[p.name]; exists {
+			continue
+		}
+		if _, exists := transforms[p.name]; !exists {
+			return nil, errors.New("Unknown query pipe: " + p.name)
+		}
+		if err := (Transform{Name: p.name, Args: p.args}).check(); err != nil {
+			return nil, err
+		}
+	}
+
+	// fixed values, and which tags need their values found
+	filter := make([]string, len(tags))
+	fixed := make([]bool, len(tags))
+	wild := false
+	for i, tag := range tags {
+		if v, given := q.matchers[tag]; given && v != "*" {
+			filter[i] = v
+			fixed[i] = true
+		} else {
+			wild = true
+		}
+	}
+
+	// derived metrics can't merge steps, each group has to be one series
+	if _, exists := c.derived[q.metric]; exists {
+		for i, tag := range tags {
+			if _, grouped := index_of(q.by, tag); !fixed[i] && !grouped {
+				return nil, errors.New("Derived metrics have to be grouped by every tag matched with *. (" + tag + ")")
+			}
+		}
+	}
+
+	series := [][]string{filter}
+	if wild {
+		if series, err = c.series(q.metric, filter, qr.Step); err != nil {
+			return nil, err
+		}
+	}
+
+	// the series of each group, with the tags that name the group
+	groups := map[string][][]string{}
+	group_tags := map[string]map[string]string{}
+next:
+	for _, tag_values := range series {
+		// series only filters on non empty values, an empty one can be asked for too
+		for i := range tags {
+			if fixed[i] && tag_values[i] != filter[i] {
+				continue next
+			}
+		}
+
+		key := make([]string, 0, len(q.by))
+		for _, tag := range q.by {
+			key = append(key, tag_values[index[tag]])
+		}
+		k := strings.Join(key, SEP)
+
+		if _, exists := groups[k]; !exists {
+			named := map[string]string{}
+			for i, tag := range tags {
+				if fixed[i] {
+					named[tag] = filter[i]
+				}
+			}
+			for _, tag := range q.by {
+				named[tag] = tag_values[index[tag]]
+			}
+			group_tags[k] = named
+		}
+		groups[k] = append(groups[k], tag_values)
+	}
+
+	mgr := MetricGraphRequest{
+		MetricName: q.metric,
+		Step:       qr.Step,
+		Fn:         q.fn,
+		Fill:       qr.Fill,
+		FillZero:   qr.FillZero,
+		NumSteps:   qr.NumSteps,
+	}
+
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	graphs := make([]*MetricGraph, 0, len(groups))
+	for _, k := range keys {
+		var g *MetricGraph
+		if m, exists := c.metrics[q.metric]; exists {
+			g, err = c.graph_series(m, groups[k], group_tags[k], mgr)
+		} else {
+			mgr.TagValues = groups[k][0]
+			if g, err = c.Graph(mgr); err == nil {
+				g.Tags = group_tags[k]
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		graphs = append(graphs, g)
+	}
+
+	for _, p := range q.pipes {
+		if pipe, exists := query_pipes[p.name]; exists {
+			if graphs, err = pipe(graphs, p.args); err != nil {
+				return nil, errors.New("Failed in " + p.name + ": " + err.Error())
+			}
+			continue
+		}
+		for _, g := range graphs {
+			if err := g.Transform(qr.Step, Transform{Name: p.name, Args: p.args}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return graphs, nil
+}
+
+func (c *Client) series(name string, filter []string, step *Timestep) ([][]string, error) {
+	// the tag values of every series written for a metric's timestep that has the
+	// filter's non empty values, a derived metric has those of any of its metrics
+	metrics := []*Metric{}
+	if m, exists := c.metrics[name]; exists {
+		metrics = append(metrics, m)
+	} else if d, exists := c.derived[name]; exists {
+		metrics = d.metrics()
+	}
+
+	seen := map[string]bool{}
+	series := [][]string{}
+	for _, m := range metrics {
+		err := c.scan_keys(filter_match(m, filter, step.Key), func(_ Storage, key string) error {
+			tag_values, _, _, ok := m.parse_key(key)
+			if !ok {
+				return nil
+			}
+			for i, v := range filter {
+				if v != "" && tag_values[i] != v {
+					return nil
+				}
+			}
+			if k := strings.Join(tag_values, SEP); !seen[k] {
+				seen[k] = true
+				series = append(series, tag_values)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return series, nil
+}
+
+func (c *Client) graph_series(m *Metric, series [][]string, tags map[string]string, mgr MetricGraphRequest) (*MetricGraph, error) {
+	// like Graph but the steps of several series are merged before picking the fn
+	if !m.has_step(mgr.Step) {
+		return nil, errors.New("That timestep is not in the list for that metric.")
+	}
+
+	points := func(now time.Time) ([]int64, map[float64]float64, error) {
+		var list []int64
+		merged := map[float64]AggregateHashData{}
+		for _, tag_values := range series {
+			smgr := mgr
+			smgr.TagValues = tag_values
+			l, data, err := m.graph_data(c.store(m, tag_values), smgr, now)
+			if err != nil {
+				return nil, nil, err
+			}
+			list = l
+			for t, d := range data {
+				merged[t] = merged[t].Merge(d)
+			}
+		}
+
+		unpacked := make(map[float64]float64, len(merged))
+		for t, d := range merged {
+			unpacked[t] = AggregateHashPick(d, mgr.Fn)
+		}
+		return list, unpacked, nil
+	}
+
+	return graph_window(tags, mgr, c.clock.Now(), points)
+}
+
+func pipe_top(graphs []*MetricGraph, args []float64) ([]*MetricGraph, error) {
+	// the n graphs with the largest total
+	return pipe_rank(graphs, args, true)
+}
+
+func pipe_bottom(graphs []*MetricGraph, args []float64) ([]*MetricGraph, error) {
+	return pipe_rank(graphs, args, false)
+}
+
+func pipe_rank(graphs []*MetricGraph, args []float64, largest bool) ([]*MetricGraph, error) {
+	if len(args) != 1 || args[0] < 0 || args[0] != math.Floor(args[0]) {
+		return nil, errors.New("takes a whole number of graphs")
+	}
+
+	ranked := graph_ranking{graphs: append([]*MetricGraph{}, graphs...), largest: largest}
+	for _, g := range ranked.graphs {
+		total := 0.0
+		for _, v := range g.Values {
+			if !math.IsNaN(v[1]) {
+				total += v[1]
+			}
+		}
+		ranked.totals = append(ranked.totals, total)
+	}
+	sort.Stable(ranked)
+
+	if n := int(args[0]); n < len(ranked.graphs) {
+		return ranked.graphs[:n], nil
+	}
+	return ranked.graphs, nil
+}
+
+type graph_ranking struct {
+	graphs  []*MetricGraph
+	totals  []float64
+	largest bool
+}
+
+func (r graph_ranking) Len() int { return len(r.graphs) }
+func (r graph_ranking) Swap(i, j int) {
+	r.graphs[i], r.graphs[j] = r.graphs[j], r.graphs[i]
+	r.totals[i], r.totals[j] = r.totals[j], r.totals[i]
+}
+func (r graph_ranking) Less(i, j int) bool {
+	if r.largest {
+		return r.totals[i] > r.totals[j]
+	}
+	return r.totals[i] < r.totals[j]
+}
+
+func index_of(list []string, s string) (int, bool) {
+	for i, v := range list {
+		if v == s {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// tokens of a query, punctuation is its own kind
+const (
+	query_ident = iota
+	query_string
+	query_number
+	query_punct
+)
+
+type query_token struct {
+	kind  int
+	value string
+}
+
+type query_parser struct {
+	tokens []query_token
+	pos    int
+}
+
+func parse_query(s string) (*query, error) {
+	tokens, err := lex_query(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &query_parser{tokens: tokens}
+
+	q := &query{fn: CountFn, matchers: map[string]string{}}
+
+	// fn(metric{...}) or just metric{...}
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	if p.punct("(") {
+		if q.fn, err = ParseMetricFn(name); err != nil {
+			return nil, err
+		}
+		if q.metric, err = p.ident(); err != nil {
+			return nil, err
+		}
+		if err := p.matchers(q); err != nil {
+			return nil, err
+		}
+		if !p.punct(")") {
+			return nil, p.expected(")")
+		}
+	} else {
+		q.metric = name
+		if err := p.matchers(q); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.peek(query_ident, "by") {
+		p.pos++
+		if !p.punct("(") {
+			return nil, p.expected("(")
+		}
+		for {
+			tag, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			q.by = append(q.by, tag)
+			if p.punct(")") {
+				break
+			}
+			if !p.punct(",") {
+				return nil, p.expected(", or )")
+			}
+		}
+	}
+
+	for p.punct("|") {
+		pipe, err := p.pipe()
+		if err != nil {
+			return nil, err
+		}
+		q.pipes = append(q.pipes, pipe)
+	}
+
+	if p.pos < len(p.tokens) {
+		return nil, errors.New("Unexpected " + p.tokens[p.pos].value + " in query.")
+	}
+	return q, nil
+}
+
+func ParseTransforms(s string) ([]Transform, error) {
+	// transforms written like query pipes, e.g. "movavg(3) | rate"
+	tokens, err := lex_query(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &query_parser{tokens: tokens}
+
+	trs := []Transform{}
+	for len(tokens) > 0 {
+		pipe, err := p.pipe()
+		if err != nil {
+			return nil, err
+		}
+		tr := Transform{Name: pipe.name, Args: pipe.args}
+		if err := tr.check(); err != nil {
+			return nil, err
+		}
+		trs = append(trs, tr)
+		if !p.punct("|") {
+			break
+		}
+	}
+
+	if p.pos < len(p.tokens) {
+		return nil, errors.New("Unexpected " + p.tokens[p.pos].value + " in transforms.")
+	}
+	return trs, nil
+}
+
+func (p *query_parser) pipe() (query_pipe, error) {
+	// name, name() or name(1, 2)
+	name, err := p.ident()
+	if err != nil {
+		return query_pipe{}, err
+	}
+	pipe := query_pipe{name: name}
+	if p.punct("(") && !p.punct(")") {
+		for {
+			if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != query_number {
+				return pipe, p.expected("a number")
+			}
+			v, err := strconv.ParseFloat(p.tokens[p.pos].value, 64)
+			if err != nil {
+				return pipe, errors.New("Bad number in query: " + p.tokens[p.pos].value)
+			}
+			p.pos++
+			pipe.args = append(pipe.args, v)
+			if p.punct(")") {
+				break
+			}
+			if !p.punct(",") {
+				return pipe, p.expected(", or )")
+			}
+		}
+	}
+	return pipe, nil
+}
+
+func (p *query_parser) matchers(q *query) error {
+	// an optional {tag="value",tag=*}
+	if !p.punct("{") || p.punct("}") {
+		return nil
+	}
+	for {
+		tag, err := p.ident()
+		if err != nil {
+			return err
+		}
+		if !p.punct("=") {
+			return p.expected("=")
+		}
+		switch {
+		case p.punct("*"):
+			q.matchers[tag] = "*"
+		case p.pos < len(p.tokens) && p.tokens[p.pos].kind == query_string:
+			q.matchers[tag] = p.tokens[p.pos].value
+			p.pos++
+		default:
+			return p.expected("a quoted value or *")
+		}
+		if p.punct("}") {
+			return nil
+		}
+		if !p.punct(",") {
+			return p.expected(", or }")
+		}
+	}
+}
+
+func (p *query_parser) peek(kind int, value string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == kind && p.tokens[p.pos].value == value
+}
+
+func (p *query_parser) punct(value string) bool {
+	// consume value if it's next
+	if p.peek(query_punct, value) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *query_parser) ident() (string, error) {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != query_ident {
+		return "", p.expected("a name")
+	}
+	p.pos++
+	return p.tokens[p.pos-1].value, nil
+}
+
+func (p *query_parser) expected(what string) error {
+	if p.pos >= len(p.tokens) {
+		return errors.New("Expected " + what + " at the end of the query.")
+	}
+	return errors.New("Expected " + what + " in query, found " + p.tokens[p.pos].value)
+}
+
+func lex_query(s string) ([]query_token, error) {
+	tokens := []query_token{}
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+
+		case strings.IndexByte("(){},=*|", c) != -1:
+			tokens = append(tokens, query_token{query_punct, string(c)})
+			i++
+
+		case c == '"':
+			// values are go style quoted strings so they can hold anything
+			end := i + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, errors.New("Unclosed quote in query.")
+			}
+			v, err := strconv.Unquote(s[i : end+1])
+			if err != nil {
+				return nil, errors.New("Bad quoted value in query: " + s[i:end+1])
+			}
+			tokens = append(tokens, query_token{query_string, v})
+			i = end + 1
+
+		case c >= '0' && c <= '9' || c == '-' || c == '.':
+			end := i + 1
+			for end < len(s) && (s[end] >= '0' && s[end] <= '9' || s[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, query_token{query_number, s[i:end]})
+			i = end
+
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			// metric names can have dots and dashes in them
+			end := i + 1
+			for end < len(s) && (s[end] == '_' || s[end] == '.' || s[end] == '-' ||
+				s[end] >= 'a' && s[end] <= 'z' || s[end] >= 'A' && s[end] <= 'Z' || s[end] >= '0' && s[end] <= '9') {
+				end++
+			}
+			tokens = append(tokens, query_token{query_ident, s[i:end]})
+			i = end
+
+		default:
+			return nil, errors.New("Unexpected " + strconv.QuoteRune(rune(c)) + " in query.")
+		}
+	}
+	return tokens, nil
+}
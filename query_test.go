@@ -0,0 +1,242 @@
+package tophat
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func query_client(t *testing.T) *Client {
+	// req and err by app and cid, with a derived ratio of the two
+	clock := NewManualClock(time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC))
+	c, err := NewMemoryClient(clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"req", "err"} {
+		err := c.AddMetric(&Metric{Name: name, Key: name, Tags: []string{"app", "cid"}, Steps: []*Timestep{TimestepHour}, Type: DefaultMetric})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.AddDerivedMetric(&DerivedMetric{Name: "ratio", Expression: "err.count / req.count"}); err != nil {
+		t.Fatal(err)
+	}
+
+	writes := []struct {
+		metric, app, cid string
+		n                int
+	}{
+		{"req", "web", "a", 3},
+		{"req", "web", "b", 1},
+		{"req", "api", "a", 5},
+		{"req", "api", "c", 2},
+		{"err", "web", "a", 1},
+		{"err", "api", "c", 1},
+	}
+	for _, w := range writes {
+		for i := 0; i < w.n; i++ {
+			err := c.Write(MetricValue{MetricName: w.metric, TagValues: []string{w.app, w.cid}, Timestamp: clock.Now(), ValueFloat: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return c
+}
+
+func query_results(graphs []*MetricGraph) []string {
+	// each graph as its tags and the value of its one step, in order
+	results := []string{}
+	for _, g := range graphs {
+		tags := []string{}
+		for tag, v := range g.Tags {
+			tags = append(tags, tag+"="+v)
+		}
+		sort.Strings(tags)
+
+		value := "none"
+		if len(g.Values) == 1 {
+			value = strconv.FormatFloat(g.Values[0][1], 'g', 4, 64)
+		}
+		results = append(results, strings.Join(tags, ",")+" "+value)
+	}
+	return results
+}
+
+func TestParseQuery(t *testing.T) {
+	q, err := parse_query(`avg(latency{app="test",cid=*}) by (cid) | top(5) | movavg(3)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &query{
+		fn:       AvgFn,
+		metric:   "latency",
+		matchers: map[string]string{"app": "test", "cid": "*"},
+		by:       []string{"cid"},
+		pipes:    []query_pipe{{"top", []float64{5}}, {"movavg", []float64{3}}},
+	}
+	if !reflect.DeepEqual(q, want) {
+		t.Errorf("got %+v, want %+v", q, want)
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{``, "Expected a name at the end of the query."},
+		{`x{a=*,}`, "Expected a name in query, found }"},
+		{`x | top(`, "Expected a number at the end of the query."},
+		{`x | top(1,`, "Expected a number at the end of the query."},
+		{`x | top(1 2)`, "Expected , or ) in query, found 2"},
+		{`x | `, "Expected a name at the end of the query."},
+		{`count(x`, "Expected ) at the end of the query."},
+		{`median(x)`, "Unknown metric function: median"},
+		{`x{a}`, "Expected = in query, found }"},
+		{`x{a=b}`, "Expected a quoted value or * in query, found b"},
+		{`x{a="b" c="d"}`, "Expected , or } in query, found c"},
+		{`x{a="b`, "Unclosed quote in query."},
+		{`x by a`, "Expected ( in query, found a"},
+		{`x by (a`, "Expected , or ) at the end of the query."},
+		{`x by ()`, "Expected a name in query, found )"},
+		{`x y`, "Unexpected y in query."},
+		{`x # y`, `Unexpected '#' in query.`},
+	}
+
+	for _, tt := range tests {
+		_, err := parse_query(tt.query)
+		if err == nil {
+			t.Errorf("%q parsed, want error %q", tt.query, tt.err)
+			continue
+		}
+		if err.Error() != tt.err {
+			t.Errorf("%q: got error %q, want %q", tt.query, err, tt.err)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	c := query_client(t)
+
+	tests := []struct {
+		query string
+		want  []string
+		err   string
+	}{
+		// every series merged, or grouped by the tags asked for
+		{query: `req`, want: []string{" 11"}},
+		{query: `req by (app)`, want: []string{"app=api 7", "app=web 4"}},
+		{query: `req by (app, cid)`, want: []string{"app=api,cid=a 5", "app=api,cid=c 2", "app=web,cid=a 3", "app=web,cid=b 1"}},
+
+		// fixed values name the graph, * matches any value
+		{query: `req{app="web"}`, want: []string{"app=web 4"}},
+		{query: `req{app="web",cid=*} by (cid)`, want: []string{"app=web,cid=a 3", "app=web,cid=b 1"}},
+		{query: `sum(req{cid="a"}) by (app)`, want: []string{"app=api,cid=a 10", "app=web,cid=a 6"}},
+		{query: `max(req{app=*}) by (app)`, want: []string{"app=api 2", "app=web 2"}},
+		{query: `req{app="nope"}`, want: []string{}},
+
+		{query: `req{app="web"} by (app)`, err: "Can't group by a tag matched to one value: app"},
+		{query: `req by (nope)`, err: "No tag nope for metric: req"},
+		{query: `req{nope="a"}`, err: "No tag nope for metric: req"},
+		{query: `missing`, err: "No metric with name: missing"},
+		{query: `req | nope`, err: "Unknown query pipe: nope"},
+		{query: `req | movavg(0)`, err: "Transform movavg needs a whole number of at least 1."},
+	}
+
+	for _, tt := range tests {
+		graphs, err := c.Query(QueryRequest{Query: tt.query, Step: TimestepHour, NumSteps: 1})
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%q: got error %v, want %q", tt.query, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if got := query_results(graphs); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestQueryDerived(t *testing.T) {
+	// derived metrics can't merge series, so every tag has to be fixed or grouped by
+	c := query_client(t)
+
+	tests := []struct {
+		query string
+		want  []string
+		err   string
+	}{
+		{query: `ratio{app="web",cid="a"}`, want: []string{"app=web,cid=a 0.3333"}},
+		{query: `ratio{app="api"} by (cid)`, want: []string{"app=api,cid=a 0", "app=api,cid=c 0.5"}},
+		{query: `ratio by (app, cid)`, want: []string{"app=api,cid=a 0", "app=api,cid=c 0.5", "app=web,cid=a 0.3333", "app=web,cid=b 0"}},
+
+		{query: `ratio`, err: "Derived metrics have to be grouped by every tag matched with *. (app)"},
+		{query: `ratio by (app)`, err: "Derived metrics have to be grouped by every tag matched with *. (cid)"},
+		{query: `ratio{app="web",cid=*}`, err: "Derived metrics have to be grouped by every tag matched with *. (cid)"},
+	}
+
+	for _, tt := range tests {
+		graphs, err := c.Query(QueryRequest{Query: tt.query, Step: TimestepHour, NumSteps: 1})
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%q: got error %v, want %q", tt.query, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if got := query_results(graphs); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestQueryRanking(t *testing.T) {
+	c := query_client(t)
+
+	tests := []struct {
+		query string
+		want  []string
+		err   string
+	}{
+		{query: `req by (app, cid) | top(2)`, want: []string{"app=api,cid=a 5", "app=web,cid=a 3"}},
+		{query: `req by (app, cid) | bottom(2)`, want: []string{"app=web,cid=b 1", "app=api,cid=c 2"}},
+		{query: `req by (app, cid) | top(10)`, want: []string{"app=api,cid=a 5", "app=web,cid=a 3", "app=api,cid=c 2", "app=web,cid=b 1"}},
+		{query: `req by (app, cid) | top(0)`, want: []string{}},
+
+		// pipes run in order, so ranking sees transformed values
+		{query: `req by (app) | scale(-1) | top(1)`, want: []string{"app=web -4"}},
+		{query: `req by (app) | top(1) | scale(2)`, want: []string{"app=api 14"}},
+
+		{query: `req by (app) | top(1.5)`, err: "Failed in top: takes a whole number of graphs"},
+		{query: `req by (app) | bottom`, err: "Failed in bottom: takes a whole number of graphs"},
+	}
+
+	for _, tt := range tests {
+		graphs, err := c.Query(QueryRequest{Query: tt.query, Step: TimestepHour, NumSteps: 1})
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%q: got error %v, want %q", tt.query, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if got := query_results(graphs); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
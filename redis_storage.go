@@ -0,0 +1,252 @@
+package tophat
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var aggregate_hash_script = redis.NewScript(1, AggregateHash)
+
+// RedisStorage keeps period hashes as redis hashes of packed values,
+// updated by the lua scripts so concurrent writers don't race
+type RedisStorage struct {
+	pool    *redis.Pool
+	cluster *Cluster
+}
+
+func NewRedisStorage(pool *redis.Pool) *RedisStorage {
+	return &RedisStorage{pool: pool}
+}
+
+func NewRedisClusterStorage(cluster *Cluster) *RedisStorage {
+	// metrics stored on a cluster need ClusterKeyLayout
+	return &RedisStorage{cluster: cluster}
+}
+
+func (s *RedisStorage) get() redis.Conn {
+	if s.cluster != nil {
+		return s.cluster.Get()
+	}
+	return s.pool.Get()
+}
+
+func (s *RedisStorage) Aggregate(writes []AggregateWrite) error {
+	if len(writes) == 0 {
+		return nil
+	}
+
+	conn := s.get()
+	defer conn.Close()
+
+	if len(writes) == 1 {
+		w := writes[0]
+		_, err := aggregate_hash_script.Do(conn, w.Key, w.Field, w.ExpireAt, w.Value)
+		return err
+	}
+
+	// pipeline anything bigger, the script has to be loaded for evalsha
+	if err := aggregate_hash_script.Load(conn); err != nil {
+		return err
+	}
+	for _, w := range writes {
+		if err := aggregate_hash_script.SendHash(conn, w.Key, w.Field, w.ExpireAt, w.Value); err != nil {
+			return err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+
+	// read every reply so the connection goes back to the pool clean
+	var err error
+	for range writes {
+		if _, e := conn.Receive(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (s *RedisStorage) Fetch(key string) (map[int]AggregateHashData, error) {
+	conn := s.get()
+	defer conn.Close()
+
+	res, err := ByteMap(conn.Do("hgetall", key))
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[int]AggregateHashData, len(res))
+	for k, v := range res {
+		offset, err := strconv.Atoi(k)
+		if err != nil {
+			continue
+		}
+		data, err := AggregateHashUnpack(v)
+		if err != nil {
+			return nil, err
+		}
+		fields[offset] = data
+	}
+	return fields, nil
+}
+
+func (s *RedisStorage) Set(key string, fields map[int]AggregateHashData, expire_at int64) error {
+	return s.fields_script(aggregate_set_script, key, fields, expire_at)
+}
+
+func (s *RedisStorage) Merge(key string, fields map[int]AggregateHashData, expire_at int64) error {
+	return s.fields_script(aggregate_merge_into_script, key, fields, expire_at)
+}
+
+func (s *RedisStorage) fields_script(script *redis.Script, key string, fields map[int]AggregateHashData, expire_at int64) error {
+	// both scripts take key, expire_time, then hash_key, packed value pairs
+	if len(fields) == 0 {
+		return nil
+	}
+
+	args := make([]interface{}, 0, 2+len(fields)*2)
+	args = append(args, key, expire_at)
+	for offset, data := range fields {
+		args = append(args, offset, AggregateHashPack(data))
+	}
+
+	conn := s.get()
+	defer conn.Close()
+
+	_, err := script.Do(conn, args...)
+	return err
+}
+
+func (s *RedisStorage) Move(src, dst string) (bool, error) {
+	// on a cluster the two keys are usually in different slots so no script can see both
+	if s.cluster != nil && key_slot(src) != key_slot(dst) {
+		return move_between(s, s, src, dst)
+	}
+
+	conn := s.get()
+	defer conn.Close()
+
+	n, err := redis.Int(aggregate_merge_script.Do(conn, src, dst))
+	return n == 1, err
+}
+
+func (s *RedisStorage) ExpireAt(key string) (int64, error) {
+	conn := s.get()
+	defer conn.Close()
+
+	// pttl is -2 for no key and -1 for no expiry, round up to the next second
+	pttl, err := redis.Int64(conn.Do("pttl", key))
+	if err != nil || pttl < 0 {
+		return 0, err
+	}
+	return (time.Now().UnixNano()/int64(time.Millisecond) + pttl + 999) / 1000, nil
+}
+
+func (s *RedisStorage) Delete(key string) error {
+	conn := s.get()
+	defer conn.Close()
+
+	_, err := conn.Do("del", key)
+	return err
+}
+
+func (s *RedisStorage) DeleteFields(key string, fields []int) error {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	args := make([]interface{}, 0, 1+len(fields))
+	args = append(args, key)
+	for _, f := range fields {
+		args = append(args, f)
+	}
+
+	conn := s.get()
+	defer conn.Close()
+
+	_, err := conn.Do("hdel", args...)
+	return err
+}
+
+func (s *RedisStorage) AddLimited(key, member string, limit int, expire_at int64) (bool, error) {
+	conn := s.get()
+	defer conn.Close()
+
+	n, err := redis.Int(series_limit_script.Do(conn, key, member, limit, expire_at))
+	return n == 1, err
+}
+
+func (s *RedisStorage) Scan(match string, fn func(key string) error) error {
+	// a cluster's keyspace is split between its masters so each is scanned in turn
+	if s.cluster != nil {
+		for _, addr := range s.cluster.masters() {
+			conn := s.cluster.node(addr).Get()
+			err := scan_keys(conn, match, fn)
+			conn.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+	return scan_keys(conn, match, fn)
+}
+
+func (s *RedisStorage) Get(key string) ([]byte, error) {
+	conn := s.get()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("get", key))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *RedisStorage) Put(key string, value []byte) error {
+	conn := s.get()
+	defer conn.Close()
+
+	_, err := conn.Do("set", key, value)
+	return err
+}
+
+func scan_keys(conn redis.Conn, match string, fn func(key string) error) error {
+	// walk the keyspace with scan rather than keys so we don't block redis
+	cursor := int64(0)
+	for {
+		values, err := redis.Values(conn.Do("scan", cursor, "match", match, "count", 1000))
+		if err != nil {
+			return errors.New("Failed scanning keys (" + match + ") " + err.Error())
+		}
+		if len(values) != 2 {
+			return errors.New("Unexpected scan reply for keys (" + match + ")")
+		}
+
+		cursor, err = redis.Int64(values[0], nil)
+		if err != nil {
+			return err
+		}
+		keys, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
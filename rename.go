@@ -0,0 +1,178 @@
+package tophat
+
+import (
+	"errors"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var AggregateMerge = `
+-- expects 2 keys: source, destination
+-- merges every packed count,sum,min,max in source into destination, then deletes source
+-- destination keeps its expiry, or takes the source's if it didn't exist
+-- once source is gone running it again does nothing
+
+-- cache lookups as locals
+local rcall = redis.call
+local src = KEYS[1]
+local dst = KEYS[2]
+
+if rcall('exists', src) == 0 then
+	return 0
+end
+
+local pttl = rcall('pttl', src)
+local dst_exists = rcall('exists', dst)
+
+local data = rcall('hgetall', src)
+for i = 1, #data, 2 do
+	local hash_key = data[i]
+	local count, sum, min, max = struct.unpack('<Iddd', data[i+1])
+
+	local existing = rcall('hget', dst, hash_key)
+	if existing then
+		local dcount, dsum, dmin, dmax = struct.unpack('<Iddd', existing)
+		count = count + dcount
+		sum = sum + dsum
+
+		-- if are way faster than math.min
+		if dmin < min then min = dmin end
+		if dmax > max then max = dmax end
+	end
+
+	rcall('hset', dst, hash_key, struct.pack('<Iddd', count, sum, min, max))
+end
+
+if dst_exists == 0 and pttl > 0 then
+	rcall('pexpire', dst, pttl)
+end
+
+rcall('del', src)
+
+return 1
+`
+
+var aggregate_merge_script = redis.NewScript(2, AggregateMerge)
+
+var AggregateMergeInto = `
+-- expects 1 key and 1 + 2n args: expire_time, then hash_key, packed value pairs
+-- the destination half of AggregateMerge for when the source is in another slot or shard
+-- merges the values read from the source, destination keeps its expiry
+-- or takes expire_time if it didn't exist
+
+-- cache lookups as locals
+local rcall = redis.call
+local dst = KEYS[1]
+local ttl = tonumber(ARGV[1])
+
+local dst_exists = rcall('exists', dst)
+
+for i = 2, #ARGV, 2 do
+	local hash_key = ARGV[i]
+	local count, sum, min, max = struct.unpack('<Iddd', ARGV[i+1])
+
+	local existing = rcall('hget', dst, hash_key)
+	if existing then
+		local dcount, dsum, dmin, dmax = struct.unpack('<Iddd', existing)
+		count = count + dcount
+		sum = sum + dsum
+
+		-- if are way faster than math.min
+		if dmin < min then min = dmin end
+		if dmax > max then max = dmax end
+	end
+
+	rcall('hset', dst, hash_key, struct.pack('<Iddd', count, sum, min, max))
+end
+
+if dst_exists == 0 and ttl > 0 then
+	rcall('expireat', dst, ttl)
+end
+
+return 1
+`
+
+var aggregate_merge_into_script = redis.NewScript(1, AggregateMergeInto)
+
+func (c *Client) RenameTagValue(metric, tag, from, to string) (int, error) {
+	// move the history of one tag value onto another, e.g. when a customer id changes
+	// every key written with the old value is merged into the key for the new value,
+	// summing counts and sums and keeping the min of mins and max of maxes
+	// each merge deletes its source, so rerunning only picks up what is left
+	m, exists := c.metrics[metric]
+	if !exists {
+		return 0, errors.New("No metric with name: " + metric)
+	}
+
+	index := -1
+	for i, t := range m.Tags {
+		if t == tag {
+			index = i
+		}
+	}
+	if index == -1 {
+		return 0, errors.New("No tag " + tag + " for metric: " + m.Name)
+	}
+	if from == to {
+		return 0, errors.New("Tag value is already " + to)
+	}
+
+	filter := make([]string, len(m.Tags))
+	filter[index] = from
+
+	moved := 0
+	err := c.scan_keys(filter_match(m, filter, ""), func(store Storage, key string) error {
+		tag_values, start, step_key, ok := m.parse_key(key)
+		if !ok || tag_values[index] != from {
+			return nil
+		}
+
+		var step *Timestep
+		for _, s := range m.Steps {
+			if s.Key == step_key {
+				step = s
+			}
+		}
+
+		renamed := make([]string, len(tag_values))
+		copy(renamed, tag_values)
+		renamed[index] = to
+		dst := m.write_key(MetricValue{TagValues: renamed, Timestamp: time.Unix(start, 0)}, step, false)
+
+		moved_key, err := c.move_key(store, c.store(m, renamed), key, dst)
+		if err != nil {
+			return errors.New("Failed merging " + key + " into " + dst + " " + err.Error())
+		}
+		if moved_key {
+			moved++
+		}
+		return nil
+	})
+
+	return moved, err
+}
+
+func (c *Client) move_key(src_store, dst_store Storage, src, dst string) (bool, error) {
+	// a series can hash to another shard, then it's read, merged and deleted
+	// here which unlike Move isn't atomic, if the delete fails a rerun merges it again
+	if src_store == dst_store {
+		return src_store.Move(src, dst)
+	}
+	return move_between(src_store, dst_store, src, dst)
+}
+
+func move_between(src_store, dst_store Storage, src, dst string) (bool, error) {
+	fields, err := src_store.Fetch(src)
+	if err != nil || len(fields) == 0 {
+		return false, err
+	}
+	expire_at, err := src_store.ExpireAt(src)
+	if err != nil {
+		return false, err
+	}
+	if err := dst_store.Merge(dst, fields, expire_at); err != nil {
+		return false, err
+	}
+	return true, src_store.Delete(src)
+}
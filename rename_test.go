@@ -0,0 +1,101 @@
+package tophat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRenameTagValue(t *testing.T) {
+	// a's history merges into c, with the same results on one store and across
+	// two, where a and c hash to different shards
+	clock := NewManualClock(time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC))
+	step := func(m int) float64 { return float64(time.Date(2024, 3, 1, 10, m, 0, 0, time.UTC).Unix()) }
+
+	stores := [][]Storage{
+		{NewMemoryStorage(clock)},
+		{NewMemoryStorage(clock), NewMemoryStorage(clock)},
+	}
+	for _, s := range stores {
+		c, err := NewStorageClient(s...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetClock(clock)
+		err = c.AddMetric(&Metric{Name: "spend", Key: "spend", Tags: []string{"cid", "app"}, Steps: []*Timestep{TimestepHour}, Type: DefaultMetric})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		writes := []struct {
+			cid    string
+			minute int
+			value  float64
+		}{
+			{"a", 5, 3}, {"a", 5, 9}, {"a", 6, 2}, {"c", 5, 1}, {"c", 5, 5},
+		}
+		for _, w := range writes {
+			mv := MetricValue{MetricName: "spend", TagValues: []string{w.cid, "web"}, Timestamp: time.Date(2024, 3, 1, 10, w.minute, 0, 0, time.UTC), ValueFloat: w.value}
+			if err := c.Write(mv); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		m := c.metrics["spend"]
+		if len(s) > 1 && c.shard_of(m, []string{"a", "web"}) == c.shard_of(m, []string{"c", "web"}) {
+			t.Fatal("a and c are on the same shard")
+		}
+
+		moved, err := c.RenameTagValue("spend", "cid", "a", "c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if moved != 1 {
+			t.Errorf("%d stores: moved %d keys, want 1", len(s), moved)
+		}
+
+		tests := []struct {
+			cid  string
+			fn   MetricFn
+			want [][2]float64
+		}{
+			{"c", CountFn, [][2]float64{{step(5), 4}, {step(6), 1}}},
+			{"c", SumFn, [][2]float64{{step(5), 18}, {step(6), 2}}},
+			{"c", MinFn, [][2]float64{{step(5), 1}, {step(6), 2}}},
+			{"c", MaxFn, [][2]float64{{step(5), 9}, {step(6), 2}}},
+			{"a", CountFn, [][2]float64{}},
+		}
+		for _, tt := range tests {
+			g, err := c.Graph(MetricGraphRequest{MetricName: "spend", TagValues: []string{tt.cid, "web"}, Step: TimestepHour, Fn: tt.fn, NumSteps: 30})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !same_values(g.Values, tt.want) {
+				t.Errorf("%d stores: %s fn %d got %v, want %v", len(s), tt.cid, tt.fn, g.Values, tt.want)
+			}
+		}
+
+		// nothing is left under a, so a rerun doesn't merge it twice
+		if moved, err := c.RenameTagValue("spend", "cid", "a", "c"); err != nil || moved != 0 {
+			t.Errorf("%d stores: rerun moved %d, %v", len(s), moved, err)
+		}
+	}
+}
+
+func TestRenameTagValueErrors(t *testing.T) {
+	c := query_client(t)
+
+	tests := []struct {
+		metric, tag, from, to string
+		err                   string
+	}{
+		{"nope", "app", "a", "b", "No metric with name: nope"},
+		{"req", "nope", "a", "b", "No tag nope for metric: req"},
+		{"req", "app", "web", "web", "Tag value is already web"},
+	}
+	for _, tt := range tests {
+		_, err := c.RenameTagValue(tt.metric, tt.tag, tt.from, tt.to)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%s %s %s->%s: got error %v, want %q", tt.metric, tt.tag, tt.from, tt.to, err, tt.err)
+		}
+	}
+}
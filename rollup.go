@@ -0,0 +1,312 @@
+package tophat
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var AggregateSet = `
+-- expects 1 key and 1 + 2n args: expire_time, then hash_key, packed value pairs
+-- overwrites hash keys with values that are already aggregated, used by rollups
+-- so running it twice with the same values leaves the same hash
+
+-- cache lookups as locals
+local rcall = redis.call
+local key = KEYS[1]
+local ttl = ARGV[1]
+
+-- check key exists so we know if we have to set an expires
+local exists = rcall('exists', key)
+
+for i = 2, #ARGV, 2 do
+	rcall('hset', key, ARGV[i], ARGV[i+1])
+end
+
+if exists == 0 then
+	rcall('expireat', key, ttl)
+end
+
+return 1
+`
+
+var aggregate_set_script = redis.NewScript(1, AggregateSet)
+
+// tophat:rollup:metric key:timestep key => end of the last period rolled up
+const rollup_checkpoints = "tophat" + SEP + "rollup" + SEP
+
+type RollupReport struct {
+	Periods int // finished periods rolled into the next timestep
+	Fields  int // hash fields written in the coarser timesteps
+}
+
+func (c *Client) Rollup(metric string, grace time.Duration) (*RollupReport, error) {
+	// with Metric.Rollup only the first timestep is written by Write, this fills in the rest
+	// every finished period of a timestep is merged into the next, hour->day->month->year,
+	// once it has been finished for grace so late writes make it in
+	// each coarse step is recomputed from all of the finer data under it and overwritten,
+	// so a pass can be rerun or overlap another. AddMetric checks the fine timestep keeps
+	// enough periods for that, steps whose fine data has started expiring are left alone
+	m, exists := c.metrics[metric]
+	if !exists {
+		return nil, errors.New("No metric with name: " + metric)
+	}
+	if !m.Rollup {
+		return nil, errors.New("Metric doesn't use rollups: " + metric)
+	}
+
+	report := &RollupReport{}
+	now := c.clock.Now()
+	limit := now.Add(-grace).Unix()
+
+	// finer steps first, so a coarse period is complete before it is rolled further
+	for i := 0; i+1 < len(m.Steps); i++ {
+		r := &rollup{
+			client: c,
+			metric: m,
+			fine:   m.Steps[i],
+			coarse: m.Steps[i+1],
+			now:    now.Unix(),
+			cache:  map[string]map[int]AggregateHashData{},
+			report: report,
+		}
+
+		// periods that finished before the checkpoint have been done already
+		// checkpoints are kept with the registry
+		checkpoint := rollup_checkpoints + m.Key + SEP + r.fine.Key
+		from := int64(0)
+		data, err := c.registry().Get(checkpoint)
+		if err != nil {
+			return report, err
+		}
+		if data != nil {
+			if from, err = strconv.ParseInt(string(data), 10, 64); err != nil {
+				return report, errors.New("Bad rollup checkpoint (" + checkpoint + ") " + err.Error())
+			}
+		}
+
+		// find the finished periods still kept for every tag combination
+		err = c.scan_keys(filter_match(m, make([]string, len(m.Tags)), r.fine.Key), func(_ Storage, key string) error {
+			tag_values, start, step_key, ok := m.parse_key(key)
+			if !ok || step_key != r.fine.Key {
+				return nil
+			}
+
+			end := r.fine.end_of_period(start)
+			if end <= from || end > limit {
+				return nil
+			}
+
+			return r.period(tag_values, start)
+		})
+		if err != nil {
+			return report, err
+		}
+
+		if err := c.registry().Put(checkpoint, []byte(strconv.FormatInt(limit, 10))); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// merges one timestep of a metric into the next
+type rollup struct {
+	client *Client
+	metric *Metric
+	fine   *Timestep
+	coarse *Timestep
+	now    int64
+	cache  map[string]map[int]AggregateHashData
+	report *RollupReport
+}
+
+func (r *rollup) period(tag_values []string, start int64) error {
+	// work out which coarse steps the period's data falls in and rebuild each of them
+	fields, err := r.fetch(tag_values, start)
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	r.report.Periods++
+
+	// coarse period start => coarse steps
+	targets := map[int64]map[int]bool{}
+	for offset := range fields {
+		ts := time.Unix(r.fine.remake_timestamp(start, offset), 0)
+		period := r.coarse.StartOfPeriod(ts)
+		if targets[period] == nil {
+			targets[period] = map[int]bool{}
+		}
+		targets[period][r.coarse.PeriodStep(ts)] = true
+	}
+
+	for period, steps := range targets {
+		// no point writing a key that would expire straight away
+		expires := r.metric.PeriodExpireAt(r.coarse, time.Unix(period, 0))
+		if expires <= r.now {
+			continue
+		}
+
+		key := r.metric.write_key(MetricValue{TagValues: tag_values, Timestamp: time.Unix(period, 0)}, r.coarse, false)
+		rolled := make(map[int]AggregateHashData, len(steps))
+
+		for step := range steps {
+			data, complete, err := r.coarse_step(tag_values, period, step)
+			if err != nil {
+				return err
+			}
+			// some of the fine data has expired, the step was written when it was all there
+			if complete {
+				rolled[step] = data
+			}
+		}
+		if len(rolled) == 0 {
+			continue
+		}
+
+		if err := r.client.store(r.metric, tag_values).Set(key, rolled, expires); err != nil {
+			return err
+		}
+		r.report.Fields += len(rolled)
+	}
+
+	return nil
+}
+
+func (r *rollup) coarse_step(tag_values []string, period int64, step int) (AggregateHashData, bool, error) {
+	// merge every fine step that falls inside the coarse step, false if
+	// a fine period it needs has already expired
+	data := AggregateHashData{}
+
+	step_start := r.coarse.remake_timestamp(period, step)
+	step_end := r.coarse.remake_timestamp(period, step+1)
+	if period_end := r.coarse.end_of_period(period); step_end > period_end || step_end <= step_start {
+		step_end = period_end
+	}
+
+	for p := r.fine.StartOfPeriod(time.Unix(step_start, 0)); p < step_end; {
+		if r.metric.PeriodExpireAt(r.fine, time.Unix(p, 0)) <= r.now {
+			return data, false, nil
+		}
+
+		fields, err := r.fetch(tag_values, p)
+		if err != nil {
+			return data, false, err
+		}
+
+		for offset, d := range fields {
+			ts := r.fine.remake_timestamp(p, offset)
+			if ts >= step_start && ts < step_end {
+				data = data.Merge(d)
+			}
+		}
+
+		next := r.fine.end_of_period(p)
+		if next <= p {
+			return data, false, errors.New("Timestep periods don't move forward: " + r.fine.Name)
+		}
+		p = next
+	}
+
+	return data, true, nil
+}
+
+func rollup_span(fine, coarse *Timestep, limit int) int {
+	// the most fine periods one coarse step covers, they all have to be kept
+	// until the step is rebuilt for the last time. a year of steps covers dst
+	// and month lengths, capped for short steps. counting stops past limit
+	most := 0
+	from := coarse.StartOfPeriod(time.Date(2000, 1, 1, 0, 0, 0, 0, coarse.Loc()))
+	until := from + 400*24*60*60
+
+	for period, steps := from, 0; period < until && steps < 20000; period = coarse.end_of_period(period) {
+		period_end := coarse.end_of_period(period)
+		if period_end <= period {
+			return most
+		}
+
+		for step := coarse.PeriodStep(time.Unix(period, 0)); ; step++ {
+			step_start := coarse.remake_timestamp(period, step)
+			step_end := coarse.remake_timestamp(period, step+1)
+			if step_start >= period_end {
+				break
+			}
+			if step_end > period_end || step_end <= step_start {
+				step_end = period_end
+			}
+			steps++
+
+			n := 0
+			for p := fine.StartOfPeriod(time.Unix(step_start, 0)); p < step_end && n <= limit; {
+				n++
+				next := fine.end_of_period(p)
+				if next <= p {
+					break
+				}
+				p = next
+			}
+			if n > most {
+				most = n
+			}
+		}
+	}
+
+	return most
+}
+
+func (r *rollup) fetch(tag_values []string, start int64) (map[int]AggregateHashData, error) {
+	// unpacked hash for a fine period, periods are read more than once when
+	// a coarse step spans several of them
+	key := r.metric.write_key(MetricValue{TagValues: tag_values, Timestamp: time.Unix(start, 0)}, r.fine, false)
+	if fields, exists := r.cache[key]; exists {
+		return fields, nil
+	}
+
+	fields, err := r.client.store(r.metric, tag_values).Fetch(key)
+	if err != nil {
+		return nil, errors.New("Failed fetching key for rollup (" + key + ") " + err.Error())
+	}
+
+	r.cache[key] = fields
+	return fields, nil
+}
+
+// runs rollups for every metric that uses them
+type RollupWorker struct {
+	Client   *Client
+	Interval time.Duration
+	Grace    time.Duration                  // how long to wait after a period ends before rolling it up
+	Errors   func(metric string, err error) // optional
+}
+
+func (w *RollupWorker) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		w.RunOnce()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *RollupWorker) RunOnce() {
+	for _, m := range w.Client.Metrics() {
+		if !m.Rollup {
+			continue
+		}
+		if _, err := w.Client.Rollup(m.Name, w.Grace); err != nil && w.Errors != nil {
+			w.Errors(m.Name, err)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+-- expects 1 key and 1 + 2n args: expire_time, then hash_key, packed value pairs
+-- overwrites hash keys with values that are already aggregated, used by rollups
+-- so running it twice with the same values leaves the same hash
+
+-- cache lookups as locals
+local rcall = redis.call
+local key = KEYS[1]
+local ttl = ARGV[1]
+
+-- check key exists so we know if we have to set an expires
+local exists = rcall('exists', key)
+
+for i = 2, #ARGV, 2 do
+	rcall('hset', key, ARGV[i], ARGV[i+1])
+end
+
+if exists == 0 then
+	rcall('expireat', key, ttl)
+end
+
+return 1
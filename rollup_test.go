@@ -0,0 +1,142 @@
+package tophat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRollup(t *testing.T) {
+	// hour is written by Write and rolled into day as each hour finishes, hour
+	// keeps 4 periods so a rollup can fall a couple of hours behind
+	at := func(h, m int) time.Time { return time.Date(2024, 3, 1, h, m, 0, 0, time.UTC) }
+	clock := NewManualClock(at(9, 10))
+	c, err := NewMemoryClient(clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.AddMetric(&Metric{Name: "hits", Key: "hits", Tags: []string{"page"}, Steps: []*Timestep{TimestepHour, TimestepDay}, Type: DefaultMetric, Rollup: true, Keep: map[string]int{"hour": 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(ts time.Time, v float64) {
+		t.Helper()
+		clock.Set(ts)
+		if err := c.Write(MetricValue{MetricName: "hits", TagValues: []string{"home"}, Timestamp: ts, ValueFloat: v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	day := func() [][2]float64 {
+		t.Helper()
+		g, err := c.Graph(MetricGraphRequest{MetricName: "hits", TagValues: []string{"home"}, Step: TimestepDay, Fn: SumFn, NumSteps: 24})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return g.Values
+	}
+	hour := func(h int, v float64) [2]float64 { return [2]float64{float64(at(h, 0).Unix()), v} }
+
+	write(at(9, 10), 1)
+	write(at(9, 20), 2)
+	write(at(10, 5), 4)
+	if got := day(); len(got) != 0 {
+		t.Fatalf("day has %v before a rollup", got)
+	}
+
+	tests := []struct {
+		name    string
+		now     time.Time
+		grace   time.Duration
+		before  func()
+		periods int
+		fields  int
+		want    [][2]float64
+	}{
+		// 09:00 isn't an hour past its end yet, then it is
+		{name: "in grace", now: at(10, 30), grace: time.Hour, want: [][2]float64{}},
+		{name: "finished", now: at(10, 30), periods: 1, fields: 1, want: [][2]float64{hour(9, 3)}},
+
+		// the checkpoint keeps a second pass from writing anything
+		{name: "again", now: at(10, 30), want: [][2]float64{hour(9, 3)}},
+
+		// several hours behind, each is caught up once
+		{name: "catch up", now: at(12, 30), before: func() { write(at(11, 15), 8) }, periods: 2, fields: 2,
+			want: [][2]float64{hour(9, 3), hour(10, 4), hour(11, 8)}},
+
+		// without the checkpoint every kept hour is rebuilt to the same values
+		{name: "rerun", now: at(12, 30), before: func() {
+			if err := c.registry().Put(rollup_checkpoints+"hits"+SEP+"h", []byte("0")); err != nil {
+				t.Fatal(err)
+			}
+		}, periods: 3, fields: 3, want: [][2]float64{hour(9, 3), hour(10, 4), hour(11, 8)}},
+
+		// 09:00 has expired from hour, its day step is left as it was
+		{name: "expired", now: at(13, 30), before: func() {
+			if err := c.registry().Put(rollup_checkpoints+"hits"+SEP+"h", []byte("0")); err != nil {
+				t.Fatal(err)
+			}
+		}, periods: 2, fields: 2, want: [][2]float64{hour(9, 3), hour(10, 4), hour(11, 8)}},
+	}
+
+	for _, tt := range tests {
+		if tt.before != nil {
+			tt.before()
+		}
+		clock.Set(tt.now)
+		report, err := c.Rollup("hits", tt.grace)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if report.Periods != tt.periods || report.Fields != tt.fields {
+			t.Errorf("%s: rolled %d periods into %d fields, want %d into %d", tt.name, report.Periods, report.Fields, tt.periods, tt.fields)
+		}
+		if got := day(); !same_values(got, tt.want) {
+			t.Errorf("%s: day is %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRollupMetric(t *testing.T) {
+	c, err := NewMemoryClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		steps []*Timestep
+		keep  map[string]int
+		err   string
+	}{
+		{[]*Timestep{TimestepHour, TimestepDay, TimestepMonth}, nil, ""},
+		{[]*Timestep{TimestepDay, TimestepHour}, nil, "Rollup metrics need their timesteps ordered finest first. (hour)"},
+
+		// a day of month covers 24 hours, all of them have to be kept until it's built
+		{[]*Timestep{TimestepHour, TimestepMonth}, nil, "Rollup metrics have to keep every period of a timestep under a step of the next, hour needs to keep 25 periods for month."},
+		{[]*Timestep{TimestepHour, TimestepMonth}, map[string]int{"hour": 24}, "Rollup metrics have to keep every period of a timestep under a step of the next, hour needs to keep 25 periods for month."},
+		{[]*Timestep{TimestepHour, TimestepMonth}, map[string]int{"hour": 25}, ""},
+	}
+
+	for i, tt := range tests {
+		name := "r" + string(rune('a'+i))
+		err := c.AddMetric(&Metric{Name: name, Key: name, Steps: tt.steps, Keep: tt.keep, Type: DefaultMetric, Rollup: true})
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%s: got error %v, want %q", name, err, tt.err)
+		}
+	}
+
+	if _, err := c.Rollup("ra", 0); err != nil {
+		t.Error(err)
+	}
+	if err := c.AddMetric(&Metric{Name: "plain", Key: "plain", Steps: []*Timestep{TimestepHour}, Type: DefaultMetric}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Rollup("plain", 0); err == nil || err.Error() != "Metric doesn't use rollups: plain" {
+		t.Errorf("got error %v for a metric without rollups", err)
+	}
+}
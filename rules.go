@@ -0,0 +1,266 @@
+package tophat
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var SeriesLimit = `
+-- expects 1 key and 3 args: member, limit, expire_time
+-- adds member to the set of series seen this period unless it already holds limit
+-- returns 1 if member is in the set, 0 if it was turned away
+
+-- cache lookups as locals
+local rcall = redis.call
+local key = KEYS[1]
+local member = ARGV[1]
+local limit = tonumber(ARGV[2])
+local ttl = ARGV[3]
+
+if rcall('sismember', key, member) == 1 then
+	return 1
+end
+
+local size = rcall('scard', key)
+if size >= limit then
+	return 0
+end
+
+rcall('sadd', key, member)
+if size == 0 then
+	rcall('expireat', key, ttl)
+end
+
+return 1
+`
+
+var series_limit_script = redis.NewScript(1, SeriesLimit)
+
+// tag values are replaced with this when folded
+const OtherTagValue = "other"
+
+// tophat:series:metric key:period start:timestep key => set of series written that period
+const series_sets = "tophat" + SEP + "series" + SEP
+
+var ErrSeriesLimit = errors.New("Metric is at its limit of series for this period.")
+
+// checks Client.Write and Client.Import make on a metric's tag values
+type TagRules struct {
+	Charset   string              `json:"charset,omitempty"`    // characters allowed in every value, empty for any
+	MaxLength int                 `json:"max_length,omitempty"` // longest value in bytes, 0 for no limit
+	Allow     map[string][]string `json:"allow,omitempty"`      // tag => the only values allowed
+	Match     map[string]string   `json:"match,omitempty"`      // tag => regexp values must match
+
+	// distinct tag combinations allowed in each period of the metric's first timestep, 0 for no limit
+	// the series seen are kept in the first storage shard
+	MaxSeries int `json:"max_series,omitempty"`
+
+	// tags set to OtherTagValue instead of rejecting the write, when their value
+	// breaks the rules or a new series would go over MaxSeries. empty rejects
+	Fold []string `json:"fold,omitempty"`
+
+	match map[string]*regexp.Regexp
+}
+
+// how the rules went for a metric's writes since the client started
+type TagCounters struct {
+	Accepted  int64 // written as given
+	Folded    int64 // written with some tags folded into OtherTagValue
+	Invalid   int64 // rejected for a value breaking the rules
+	OverLimit int64 // rejected for a new series over MaxSeries
+}
+
+// the series a metric is known to have written in its current limit period,
+// saves asking storage again for every write
+type series_cache struct {
+	mu      sync.Mutex
+	start   int64
+	members map[string]bool
+}
+
+func (r *TagRules) compile(m *Metric) error {
+	// check the rules are for the metric's tags and compile the patterns
+	has_tag := func(tag string) bool {
+		for _, t := range m.Tags {
+			if t == tag {
+				return true
+			}
+		}
+		return false
+	}
+
+	for tag := range r.Allow {
+		if !has_tag(tag) {
+			return errors.New("Tag rules for a tag the metric doesn't have. (" + tag + ")")
+		}
+	}
+	for _, tag := range r.Fold {
+		if !has_tag(tag) {
+			return errors.New("Tag rules fold a tag the metric doesn't have. (" + tag + ")")
+		}
+	}
+
+	r.match = map[string]*regexp.Regexp{}
+	for tag, pattern := range r.Match {
+		if !has_tag(tag) {
+			return errors.New("Tag rules for a tag the metric doesn't have. (" + tag + ")")
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return errors.New("Bad tag pattern for " + tag + ": " + err.Error())
+		}
+		r.match[tag] = re
+	}
+
+	if r.MaxSeries < 0 || r.MaxLength < 0 {
+		return errors.New("Tag rule limits can't be negative.")
+	}
+	return nil
+}
+
+func (r *TagRules) check(tag, value string) error {
+	// why a value breaks the rules, nil if it doesn't
+	if r.MaxLength > 0 && len(value) > r.MaxLength {
+		return errors.New("Value for tag " + tag + " is longer than " + strconv.Itoa(r.MaxLength) + ".")
+	}
+	if r.Charset != "" {
+		for _, c := range value {
+			if !strings.ContainsRune(r.Charset, c) {
+				return errors.New("Value for tag " + tag + " has a character outside the allowed set: " + strconv.QuoteRune(c))
+			}
+		}
+	}
+	if allow, exists := r.Allow[tag]; exists {
+		found := false
+		for _, a := range allow {
+			if a == value {
+				found = true
+			}
+		}
+		if !found {
+			return errors.New("Value for tag " + tag + " isn't in the allowed list: " + value)
+		}
+	}
+	if re, exists := r.match[tag]; exists && !re.MatchString(value) {
+		return errors.New("Value for tag " + tag + " doesn't match " + re.String() + ": " + value)
+	}
+	return nil
+}
+
+func (r *TagRules) folds(tag string) bool {
+	for _, t := range r.Fold {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) apply_rules(m *Metric, mv MetricValue) (MetricValue, error) {
+	// check a value's tags against the metric's rules, folding what it can
+	// returns the value to write, which may have new tag values
+	if m.Rules == nil {
+		return mv, nil
+	}
+	counters := c.counters[m.Name]
+
+	folded := false
+	tag_values := mv.TagValues
+	fold := func(i int) {
+		if !folded {
+			tag_values = append([]string{}, mv.TagValues...)
+			folded = true
+		}
+		tag_values[i] = OtherTagValue
+	}
+
+	for i, tag := range m.Tags {
+		if err := m.Rules.check(tag, tag_values[i]); err != nil {
+			if !m.Rules.folds(tag) {
+				atomic.AddInt64(&counters.Invalid, 1)
+				return mv, err
+			}
+			fold(i)
+		}
+	}
+
+	// series that are already folded are always let in, or the limit would swallow them too
+	if m.Rules.MaxSeries > 0 && !folded {
+		ok, err := c.admit_series(m, tag_values, mv)
+		if err != nil {
+			return mv, err
+		}
+		if !ok {
+			if len(m.Rules.Fold) == 0 {
+				atomic.AddInt64(&counters.OverLimit, 1)
+				return mv, ErrSeriesLimit
+			}
+			for i, tag := range m.Tags {
+				if m.Rules.folds(tag) {
+					fold(i)
+				}
+			}
+		}
+	}
+
+	if folded {
+		atomic.AddInt64(&counters.Folded, 1)
+		mv.TagValues = tag_values
+	} else {
+		atomic.AddInt64(&counters.Accepted, 1)
+	}
+	return mv, nil
+}
+
+func (c *Client) admit_series(m *Metric, tag_values []string, mv MetricValue) (bool, error) {
+	// whether a series fits under the limit for the period the value is in
+	step := m.Steps[0]
+	start := step.StartOfPeriod(mv.Timestamp)
+	key := series_sets + m.Key + SEP + strconv.FormatInt(start, 10) + SEP + step.Key
+	member := m.series_key(tag_values)
+
+	cache := c.series_seen[m.Name]
+	cache.mu.Lock()
+	if cache.start == start && cache.members[member] {
+		cache.mu.Unlock()
+		return true, nil
+	}
+	cache.mu.Unlock()
+
+	ok, err := c.registry().AddLimited(key, member, m.Rules.MaxSeries, step.end_of_period(start))
+	if err != nil || !ok {
+		return false, err
+	}
+
+	// only the newest period is cached, late writes for older ones just go to storage
+	cache.mu.Lock()
+	if start > cache.start {
+		cache.start = start
+		cache.members = map[string]bool{}
+	}
+	if start == cache.start {
+		cache.members[member] = true
+	}
+	cache.mu.Unlock()
+
+	return true, nil
+}
+
+func (c *Client) TagCounters(metric string) (TagCounters, error) {
+	counters, exists := c.counters[metric]
+	if !exists {
+		return TagCounters{}, errors.New("No metric with name: " + metric)
+	}
+	return TagCounters{
+		Accepted:  atomic.LoadInt64(&counters.Accepted),
+		Folded:    atomic.LoadInt64(&counters.Folded),
+		Invalid:   atomic.LoadInt64(&counters.Invalid),
+		OverLimit: atomic.LoadInt64(&counters.OverLimit),
+	}, nil
+}
@@ -0,0 +1,157 @@
+package tophat
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func rules_client(t *testing.T, clock Clock, rules *TagRules) *Client {
+	c, err := NewMemoryClient(clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.AddMetric(&Metric{Name: "req", Key: "req", Tags: []string{"app", "cid"}, Steps: []*Timestep{TimestepHour}, Type: DefaultMetric, Rules: rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestTagRules(t *testing.T) {
+	// values breaking a rule are rejected, or written as other when their tag folds
+	clock := NewManualClock(time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC))
+
+	tests := []struct {
+		rules *TagRules
+		tags  []string
+		want  []string
+		err   string
+	}{
+		{rules: &TagRules{Charset: "abcdefghijklmnopqrstuvwxyz"}, tags: []string{"web", "a"}, want: []string{"app=web,cid=a 1"}},
+		{rules: &TagRules{Charset: "abcdefghijklmnopqrstuvwxyz"}, tags: []string{"web", "A"}, err: "Value for tag cid has a character outside the allowed set: 'A'"},
+		{rules: &TagRules{MaxLength: 3}, tags: []string{"web", "abcd"}, err: "Value for tag cid is longer than 3."},
+		{rules: &TagRules{Allow: map[string][]string{"app": {"web", "api"}}}, tags: []string{"cli", "a"}, err: "Value for tag app isn't in the allowed list: cli"},
+		{rules: &TagRules{Match: map[string]string{"cid": "^[0-9]+$"}}, tags: []string{"web", "x1"}, err: "Value for tag cid doesn't match ^[0-9]+$: x1"},
+
+		// only folded tags change, the rest of the value is written as given
+		{rules: &TagRules{Allow: map[string][]string{"app": {"web", "api"}}, Fold: []string{"app"}}, tags: []string{"cli", "a"}, want: []string{"app=other,cid=a 1"}},
+		{rules: &TagRules{MaxLength: 3, Fold: []string{"cid"}}, tags: []string{"web", "abcd"}, want: []string{"app=web,cid=other 1"}},
+		{rules: &TagRules{MaxLength: 3, Fold: []string{"cid"}}, tags: []string{"web", "abc"}, want: []string{"app=web,cid=abc 1"}},
+		{rules: &TagRules{MaxLength: 3, Fold: []string{"app"}}, tags: []string{"web", "abcd"}, err: "Value for tag cid is longer than 3."},
+	}
+
+	for _, tt := range tests {
+		c := rules_client(t, clock, tt.rules)
+		err := c.Write(MetricValue{MetricName: "req", TagValues: tt.tags, Timestamp: clock.Now(), ValueFloat: 1})
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%+v %q: got error %v, want %q", tt.rules, tt.tags, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v %q: %v", tt.rules, tt.tags, err)
+			continue
+		}
+
+		graphs, err := c.Query(QueryRequest{Query: `req by (app, cid)`, Step: TimestepHour, NumSteps: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := query_results(graphs); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v %q: got %q, want %q", tt.rules, tt.tags, got, tt.want)
+		}
+	}
+}
+
+func TestTagRulesCompile(t *testing.T) {
+	tests := []struct {
+		rules *TagRules
+		err   string
+	}{
+		{&TagRules{Allow: map[string][]string{"nope": {"a"}}}, "Tag rules for a tag the metric doesn't have. (nope)"},
+		{&TagRules{Match: map[string]string{"nope": "a"}}, "Tag rules for a tag the metric doesn't have. (nope)"},
+		{&TagRules{Fold: []string{"nope"}}, "Tag rules fold a tag the metric doesn't have. (nope)"},
+		{&TagRules{Match: map[string]string{"cid": "("}}, "Bad tag pattern for cid: error parsing regexp: missing closing ): `(`"},
+		{&TagRules{MaxSeries: -1}, "Tag rule limits can't be negative."},
+	}
+
+	for _, tt := range tests {
+		c, err := NewMemoryClient(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.AddMetric(&Metric{Name: "req", Key: "req", Tags: []string{"app", "cid"}, Steps: []*Timestep{TimestepHour}, Type: DefaultMetric, Rules: tt.rules})
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%+v: got error %v, want %q", tt.rules, err, tt.err)
+		}
+	}
+}
+
+func TestSeriesLimit(t *testing.T) {
+	// two series an hour, new ones after that fold into cid other or are turned away
+	clock := NewManualClock(time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC))
+
+	tests := []struct {
+		fold     []string
+		writes   []string // cids, in order
+		want     []string
+		counters TagCounters
+		errs     int
+	}{
+		{fold: []string{"cid"}, writes: []string{"a", "b", "c", "a", "d", "b"},
+			want:     []string{"app=web,cid=a 2", "app=web,cid=b 2", "app=web,cid=other 2"},
+			counters: TagCounters{Accepted: 4, Folded: 2}},
+		{fold: nil, writes: []string{"a", "b", "c", "a", "d", "b"},
+			want:     []string{"app=web,cid=a 2", "app=web,cid=b 2"},
+			counters: TagCounters{Accepted: 4, OverLimit: 2}, errs: 2},
+
+		// values folded by a rule don't count towards the limit, or take a place once it's full
+		{fold: []string{"cid"}, writes: []string{"a", "TOOLONG", "b", "c", "TOOLONG"},
+			want:     []string{"app=web,cid=a 1", "app=web,cid=b 1", "app=web,cid=other 3"},
+			counters: TagCounters{Accepted: 2, Folded: 3}},
+	}
+
+	for _, tt := range tests {
+		clock.Set(time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC))
+		c := rules_client(t, clock, &TagRules{MaxSeries: 2, MaxLength: 5, Fold: tt.fold})
+
+		errs := 0
+		for _, cid := range tt.writes {
+			err := c.Write(MetricValue{MetricName: "req", TagValues: []string{"web", cid}, Timestamp: clock.Now(), ValueFloat: 1})
+			if err == ErrSeriesLimit {
+				errs++
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if errs != tt.errs {
+			t.Errorf("fold %q: %d writes over the limit, want %d", tt.fold, errs, tt.errs)
+		}
+
+		graphs, err := c.Query(QueryRequest{Query: `req by (app, cid)`, Step: TimestepHour, NumSteps: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := query_results(graphs); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("fold %q: got %q, want %q", tt.fold, got, tt.want)
+		}
+		if counters, _ := c.TagCounters("req"); counters != tt.counters {
+			t.Errorf("fold %q: counters %+v, want %+v", tt.fold, counters, tt.counters)
+		}
+
+		// the limit is per period of the first timestep, the next hour starts again
+		clock.Add(time.Hour)
+		if err := c.Write(MetricValue{MetricName: "req", TagValues: []string{"web", "z"}, Timestamp: clock.Now(), ValueFloat: 1}); err != nil {
+			t.Errorf("fold %q: next hour: %v", tt.fold, err)
+		}
+		graphs, err = c.Query(QueryRequest{Query: `req{cid="z"} by (app)`, Step: TimestepHour, NumSteps: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := query_results(graphs); !reflect.DeepEqual(got, []string{"app=web,cid=z 1"}) {
+			t.Errorf("fold %q: next hour got %q", tt.fold, got)
+		}
+	}
+}
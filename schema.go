@@ -0,0 +1,301 @@
+package tophat
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// redis key the schema is stored under so tools can share one definition
+const RegistryKey = "tophat" + SEP + "schema"
+
+// a serialisable description of the timesteps and metrics loaded in a client
+type Schema struct {
+	Timesteps []SchemaTimestep `json:"timesteps"`
+	Metrics   []SchemaMetric   `json:"metrics"`
+	Derived   []SchemaDerived  `json:"derived,omitempty"`
+}
+
+type SchemaTimestep struct {
+	Name      string          `json:"name"`
+	Key       string          `json:"key"`
+	Period    string          `json:"period"`
+	Keep      int             `json:"keep"`
+	NumSteps  int             `json:"steps"`
+	Location  string          `json:"location,omitempty"`
+	Width     string          `json:"width,omitempty"`      // step width as a duration, e.g. 5m
+	WeekStart string          `json:"week_start,omitempty"` // week periods only, defaults to monday like Timestep
+	Calendar  *SchemaCalendar `json:"calendar,omitempty"`
+}
+
+// the built in calendars, custom Calendar types can't be stored in a schema
+type SchemaCalendar struct {
+	Type       string `json:"type"`                  // fiscal_year or weeks
+	StartMonth int    `json:"start_month,omitempty"` // fiscal_year
+	Epoch      string `json:"epoch,omitempty"`       // weeks, as 2006-01-02
+	Weeks      []int  `json:"weeks,omitempty"`       // weeks, e.g. [4,4,5]
+}
+
+type SchemaMetric struct {
+	Name           string         `json:"name"`
+	Key            string         `json:"key"`
+	Tags           []string       `json:"tags"`
+	Steps          []string       `json:"steps"`
+	HighResolution bool           `json:"high_resolution,omitempty"`
+	Rollup         bool           `json:"rollup,omitempty"`
+	Keep           map[string]int `json:"keep,omitempty"`   // retention overrides by timestep name
+	Layout         string         `json:"layout,omitempty"` // "cluster" for ClusterKeyLayout
+	Rules          *TagRules      `json:"rules,omitempty"`
+}
+
+type SchemaDerived struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+}
+
+func ReadSchema(r io.Reader) (*Schema, error) {
+	s := &Schema{}
+	if err := json.NewDecoder(r).Decode(s); err != nil {
+		return nil, errors.New("Failed reading schema: " + err.Error())
+	}
+	return s, nil
+}
+
+func (c *Client) LoadSchema(s *Schema) error {
+	// timesteps first so the metrics can refer to them
+	for _, st := range s.Timesteps {
+		period, err := ParseTime(st.Period)
+		if err != nil {
+			return err
+		}
+
+		t := &Timestep{
+			Name:     st.Name,
+			Key:      st.Key,
+			Period:   period,
+			Keep:     st.Keep,
+			NumSteps: st.NumSteps,
+		}
+
+		if st.Location != "" {
+			if t.Location, err = time.LoadLocation(st.Location); err != nil {
+				return errors.New("Unknown location for timestep " + st.Name + ": " + st.Location)
+			}
+		}
+
+		if st.Width != "" {
+			if t.StepWidth, err = time.ParseDuration(st.Width); err != nil {
+				return errors.New("Bad width for timestep " + st.Name + ": " + st.Width)
+			}
+		}
+
+		if period == Week {
+			if t.WeekStart, err = parse_weekday(st.WeekStart); err != nil {
+				return err
+			}
+		}
+
+		if st.Calendar != nil {
+			if t.Calendar, err = st.Calendar.calendar(); err != nil {
+				return errors.New("Bad calendar for timestep " + st.Name + ": " + err.Error())
+			}
+		}
+
+		// an identical step is already loaded, e.g. the defaults
+		if existing, exists := c.steps[t.Name]; exists && same_timestep(existing, t) {
+			continue
+		}
+
+		if err := c.AddTimestep(t); err != nil {
+			return err
+		}
+	}
+
+	for _, sm := range s.Metrics {
+		m := &Metric{
+			Name:  sm.Name,
+			Key:   sm.Key,
+			Tags:  sm.Tags,
+			Steps: make([]*Timestep, 0, len(sm.Steps)),
+			Type:  DefaultMetric,
+
+			HighResolution: sm.HighResolution,
+			Rollup:         sm.Rollup,
+			Keep:           sm.Keep,
+			Rules:          sm.Rules,
+		}
+
+		switch sm.Layout {
+		case "":
+		case "cluster":
+			m.Layout = ClusterKeyLayout
+		default:
+			return errors.New("Unknown key layout for metric " + sm.Name + ": " + sm.Layout)
+		}
+
+		for _, name := range sm.Steps {
+			step, exists := c.steps[name]
+			if !exists {
+				return errors.New("Step name not loaded, load it before adding metrics. (" + name + ")")
+			}
+			m.Steps = append(m.Steps, step)
+		}
+
+		if err := c.AddMetric(m); err != nil {
+			return err
+		}
+	}
+
+	// derived last as they refer to metrics
+	for _, sd := range s.Derived {
+		if err := c.AddDerivedMetric(&DerivedMetric{Name: sd.Name, Expression: sd.Expression}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parse_weekday(name string) (WeekStart, error) {
+	// iso weeks start on monday so that's the default, the same as a Timestep made in go
+	if name == "" {
+		return Monday, nil
+	}
+	for d := Monday; d <= Sunday; d++ {
+		if strings.EqualFold(d.String(), name) {
+			return d, nil
+		}
+	}
+	return 0, errors.New("Unknown week start day: " + name)
+}
+
+func (sc *SchemaCalendar) calendar() (Calendar, error) {
+	switch sc.Type {
+	case "fiscal_year":
+		if sc.StartMonth < 1 || sc.StartMonth > 12 {
+			return nil, errors.New("start_month must be 1 to 12")
+		}
+		return FiscalYearCalendar{StartMonth: time.Month(sc.StartMonth)}, nil
+
+	case "weeks":
+		epoch, err := time.Parse("2006-01-02", sc.Epoch)
+		if err != nil {
+			return nil, err
+		}
+		return WeekPatternCalendar{Epoch: epoch, Weeks: sc.Weeks}, nil
+	}
+
+	return nil, errors.New("unknown calendar type " + sc.Type)
+}
+
+func schema_calendar(c Calendar) (*SchemaCalendar, bool) {
+	// false for custom calendars, there's no way to load them back
+	switch cal := c.(type) {
+	case FiscalYearCalendar:
+		return &SchemaCalendar{Type: "fiscal_year", StartMonth: int(cal.StartMonth)}, true
+	case WeekPatternCalendar:
+		return &SchemaCalendar{Type: "weeks", Epoch: cal.Epoch.Format("2006-01-02"), Weeks: cal.Weeks}, true
+	}
+	return nil, false
+}
+
+func same_timestep(a, b *Timestep) bool {
+	// locations loaded separately are different pointers, compare them by name
+	return a.Name == b.Name && a.Key == b.Key && a.Period == b.Period && a.Keep == b.Keep &&
+		a.NumSteps == b.NumSteps && a.StepWidth == b.StepWidth && a.WeekStart == b.WeekStart && a.Loc().String() == b.Loc().String() &&
+		reflect.DeepEqual(a.Calendar, b.Calendar)
+}
+
+func (c *Client) Schema() (*Schema, error) {
+	// errors for timesteps with a custom Calendar, a schema couldn't load them
+	s := &Schema{
+		Timesteps: make([]SchemaTimestep, 0, len(c.steps)),
+		Metrics:   make([]SchemaMetric, 0, len(c.metrics)),
+	}
+
+	for _, t := range c.Timesteps() {
+		st := SchemaTimestep{
+			Name:     t.Name,
+			Key:      t.Key,
+			Period:   t.Period.String(),
+			Keep:     t.Keep,
+			NumSteps: t.NumSteps,
+		}
+		if t.Location != nil {
+			st.Location = t.Location.String()
+		}
+		if t.StepWidth > 0 {
+			st.Width = t.StepWidth.String()
+		}
+		if t.Period == Week {
+			st.WeekStart = strings.ToLower(t.WeekStart.String())
+		}
+		if t.Calendar != nil {
+			var ok bool
+			if st.Calendar, ok = schema_calendar(t.Calendar); !ok {
+				return nil, errors.New("Timestep " + t.Name + " uses a custom calendar, which can't be saved in a schema.")
+			}
+		}
+		s.Timesteps = append(s.Timesteps, st)
+	}
+
+	for _, m := range c.Metrics() {
+		sm := SchemaMetric{
+			Name:  m.Name,
+			Key:   m.Key,
+			Tags:  m.Tags,
+			Steps: make([]string, 0, len(m.Steps)),
+
+			HighResolution: m.HighResolution,
+			Rollup:         m.Rollup,
+			Keep:           m.Keep,
+			Rules:          m.Rules,
+		}
+		if m.Layout == ClusterKeyLayout {
+			sm.Layout = "cluster"
+		}
+		for _, step := range m.Steps {
+			sm.Steps = append(sm.Steps, step.Name)
+		}
+		s.Metrics = append(s.Metrics, sm)
+	}
+
+	for _, d := range c.DerivedMetrics() {
+		s.Derived = append(s.Derived, SchemaDerived{Name: d.Name, Expression: d.Expression})
+	}
+
+	return s, nil
+}
+
+func (c *Client) LoadRegistry() error {
+	data, err := c.registry().Get(RegistryKey)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return errors.New("No schema in the registry (" + RegistryKey + ")")
+	}
+
+	s := &Schema{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return errors.New("Failed reading schema from registry: " + err.Error())
+	}
+
+	return c.LoadSchema(s)
+}
+
+func (c *Client) SaveRegistry() error {
+	s, err := c.Schema()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return c.registry().Put(RegistryKey, data)
+}
@@ -0,0 +1,106 @@
+package tophat
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// a Calendar a schema has no way to describe
+type test_calendar struct{ FiscalYearCalendar }
+
+func TestSchemaCustomCalendar(t *testing.T) {
+	// the registry is only written if it can be loaded back
+	c, err := NewMemoryClient(NewManualClock(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddTimestep(&Timestep{Name: "fy", Key: "fy", Period: Year, Keep: 2, NumSteps: 12, Calendar: FiscalYearCalendar{StartMonth: time.July}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SaveRegistry(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.AddTimestep(&Timestep{Name: "custom", Key: "c", Period: Year, Keep: 2, NumSteps: 12, Calendar: test_calendar{FiscalYearCalendar{StartMonth: time.April}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Schema(); err == nil {
+		t.Error("Schema saved a custom calendar")
+	}
+	if err := c.SaveRegistry(); err == nil {
+		t.Error("SaveRegistry saved a custom calendar")
+	}
+
+	// the registry still has what was saved before
+	loaded, err := NewStorageClient(c.stores...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.LoadRegistry(); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := loaded.steps["fy"]; !exists {
+		t.Error("fy timestep wasn't loaded from the registry")
+	}
+}
+
+func TestSchemaWeekStart(t *testing.T) {
+	// a schema without week_start loads monday weeks, and saves them as monday
+	tests := []struct {
+		json string
+		want WeekStart
+		err  string
+	}{
+		{`{"timesteps":[{"name":"wk","key":"wk","period":"week","keep":2,"steps":7}]}`, Monday, ""},
+		{`{"timesteps":[{"name":"wk","key":"wk","period":"week","keep":2,"steps":7,"week_start":"sunday"}]}`, Sunday, ""},
+		{`{"timesteps":[{"name":"wk","key":"wk","period":"week","keep":2,"steps":7,"week_start":"Wednesday"}]}`, Wednesday, ""},
+		{`{"timesteps":[{"name":"wk","key":"wk","period":"week","keep":2,"steps":7,"week_start":"someday"}]}`, 0, "Unknown week start day: someday"},
+	}
+
+	for _, tt := range tests {
+		s, err := ReadSchema(strings.NewReader(tt.json))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := NewMemoryClient(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.LoadSchema(s)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: got error %v, want %q", tt.json, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.json, err)
+			continue
+		}
+		step := c.steps["wk"]
+		if step.WeekStart != tt.want {
+			t.Errorf("%s: week starts %s, want %s", tt.json, step.WeekStart, tt.want)
+		}
+
+		saved, err := c.Schema()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, st := range saved.Timesteps {
+			if st.Name == "wk" && st.WeekStart != strings.ToLower(tt.want.String()) {
+				t.Errorf("%s: saved week_start %q, want %q", tt.json, st.WeekStart, strings.ToLower(tt.want.String()))
+			}
+		}
+		again, err := NewMemoryClient(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := again.LoadSchema(saved); err != nil {
+			t.Fatal(err)
+		}
+		if !same_timestep(again.steps["wk"], step) {
+			t.Errorf("%s: loaded back as %+v, want %+v", tt.json, again.steps["wk"], step)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+-- expects 1 key and 3 args: member, limit, expire_time
+-- adds member to the set of series seen this period unless it already holds limit
+-- returns 1 if member is in the set, 0 if it was turned away
+
+-- cache lookups as locals
+local rcall = redis.call
+local key = KEYS[1]
+local member = ARGV[1]
+local limit = tonumber(ARGV[2])
+local ttl = ARGV[3]
+
+if rcall('sismember', key, member) == 1 then
+	return 1
+end
+
+local size = rcall('scard', key)
+if size >= limit then
+	return 0
+end
+
+rcall('sadd', key, member)
+if size == 0 then
+	rcall('expireat', key, ttl)
+end
+
+return 1
@@ -0,0 +1,67 @@
+package tophat
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// points each shard gets on the hash ring, more spreads series more evenly
+const shard_replicas = 160
+
+type ring_point struct {
+	hash  uint32
+	shard int
+}
+
+type hash_ring []ring_point
+
+func (r hash_ring) Len() int           { return len(r) }
+func (r hash_ring) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r hash_ring) Less(i, j int) bool { return r[i].hash < r[j].hash }
+
+func new_hash_ring(shards int) hash_ring {
+	// points are named by shard position, so appending a pool only takes the series
+	// that land on its points and everything else stays where it was
+	ring := make(hash_ring, 0, shards*shard_replicas)
+	for shard := 0; shard < shards; shard++ {
+		for i := 0; i < shard_replicas; i++ {
+			ring = append(ring, ring_point{
+				hash:  ring_hash("shard" + SEP + strconv.Itoa(shard) + SEP + strconv.Itoa(i)),
+				shard: shard,
+			})
+		}
+	}
+	sort.Sort(ring)
+	return ring
+}
+
+func (r hash_ring) shard(key string) int {
+	// the first point clockwise from the key's hash
+	h := ring_hash(key)
+	i := sort.Search(len(r), func(i int) bool { return r[i].hash >= h })
+	if i == len(r) {
+		i = 0
+	}
+	return r[i].shard
+}
+
+func ring_hash(s string) uint32 {
+	sum := md5.Sum([]byte(s))
+	return binary.LittleEndian.Uint32(sum[:4])
+}
+
+func (c *Client) shard_of(m *Metric, tag_values []string) int {
+	// every period of a series lives on the same shard
+	if len(c.stores) <= 1 {
+		return 0
+	}
+	return c.ring.shard(m.Key + SEP + strings.Join(tag_values, SEP))
+}
+
+func (c *Client) store(m *Metric, tag_values []string) Storage {
+	// the storage a series lives in
+	return c.stores[c.shard_of(m, tag_values)]
+}
@@ -0,0 +1,165 @@
+package tophat
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// eighth blocks, lowest to highest
+var spark_blocks = []rune("▁▂▃▄▅▆▇█")
+
+func (mg *MetricGraph) Sparkline() string {
+	// scale every value between the min and max of the graph onto a block
+	// NaN gaps are left blank
+	spark := mg.Spark()
+	if len(spark) == 0 {
+		return ""
+	}
+
+	min, max := spark_range(spark)
+	levels := len(spark_blocks) - 1
+
+	s := make([]rune, 0, len(spark))
+	for _, v := range spark {
+		if math.IsNaN(v) {
+			s = append(s, ' ')
+			continue
+		}
+		level := 0
+		if max > min {
+			level = int((v-min)/(max-min)*float64(levels) + 0.5)
+		}
+		s = append(s, spark_blocks[level])
+	}
+	return string(s)
+}
+
+func (mg *MetricGraph) Chart(height int) string {
+	// draw an ascii bar chart, one column per value, like
+	//   12 |    #
+	//      |   ##  #
+	//    0 |#####  ##
+	//      +---------
+	//       05:00   05:08
+	//   max 12 at 2015-03-26 05:04, min 0 at 2015-03-26 05:00
+	if len(mg.Values) == 0 || !has_values(mg.Spark()) {
+		return "no data\n"
+	}
+	if height < 2 {
+		height = 2
+	}
+
+	spark := mg.Spark()
+	min, max := spark_range(spark)
+
+	// the axis floor sits at zero unless everything is negative
+	floor := min
+	if floor > 0 {
+		floor = 0
+	}
+
+	top_label := format_chart_value(max)
+	bottom_label := format_chart_value(floor)
+	label_width := len(top_label)
+	if len(bottom_label) > label_width {
+		label_width = len(bottom_label)
+	}
+
+	// how many rows each value fills, gaps fill none
+	fill := make([]int, len(spark))
+	for i, v := range spark {
+		if max > floor && !math.IsNaN(v) {
+			fill[i] = int((v-floor)/(max-floor)*float64(height) + 0.5)
+		}
+	}
+
+	var b bytes.Buffer
+	for row := height; row > 0; row-- {
+		label := ""
+		switch row {
+		case height:
+			label = top_label
+		case 1:
+			label = bottom_label
+		}
+		b.WriteString(strings.Repeat(" ", label_width-len(label)) + label + " |")
+
+		for _, f := range fill {
+			if f >= row {
+				b.WriteByte('#')
+			} else {
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteString("\n")
+	}
+
+	pad := strings.Repeat(" ", label_width+1)
+	b.WriteString(pad + "+" + strings.Repeat("-", len(spark)) + "\n")
+
+	// first and last timestamps under the ends of the x axis
+	first := format_chart_time(mg.Values[0][0], "15:04")
+	last := format_chart_time(mg.Values[len(mg.Values)-1][0], "15:04")
+	gap := len(spark) - len(first) - len(last)
+	if gap < 1 {
+		gap = 1
+	}
+	b.WriteString(pad + " " + first + strings.Repeat(" ", gap) + last + "\n")
+
+	// annotate where the extremes happened
+	min_at, max_at := mg.Values[0][0], mg.Values[0][0]
+	for _, v := range mg.Values {
+		if v[1] == min {
+			min_at = v[0]
+			break
+		}
+	}
+	for _, v := range mg.Values {
+		if v[1] == max {
+			max_at = v[0]
+			break
+		}
+	}
+	b.WriteString(pad + " max " + format_chart_value(max) + " at " + format_chart_time(max_at, "2006-01-02 15:04"))
+	b.WriteString(", min " + format_chart_value(min) + " at " + format_chart_time(min_at, "2006-01-02 15:04") + "\n")
+
+	return b.String()
+}
+
+func spark_range(values []float64) (min, max float64) {
+	// NaN gaps are skipped, with nothing but gaps it's 0 to 0
+	first := true
+	for _, v := range values {
+		if math.IsNaN(v) {
+			continue
+		}
+		if first || v < min {
+			min = v
+		}
+		if first || v > max {
+			max = v
+		}
+		first = false
+	}
+	return min, max
+}
+
+func has_values(values []float64) bool {
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func format_chart_value(v float64) string {
+	return strconv.FormatFloat(v, 'g', 6, 64)
+}
+
+func format_chart_time(ts float64, layout string) string {
+	return time.Unix(int64(ts), 0).UTC().Format(layout)
+}
@@ -0,0 +1,47 @@
+package tophat
+
+// Storage holds the period hashes metrics are written to, one per write_key, with
+// a field per step offset holding the aggregated count,sum,min,max for that step.
+// keys expire at the time given when they are created, later writes keep it.
+// RedisStorage is the usual one, others only need to keep the same semantics
+type Storage interface {
+	// add each value to the step at its key and field, creating the key if needed
+	Aggregate(writes []AggregateWrite) error
+
+	// every step of a period hash, empty if the key doesn't exist
+	Fetch(key string) (map[int]AggregateHashData, error)
+
+	// overwrite steps with already aggregated data, used by rollups
+	Set(key string, fields map[int]AggregateHashData, expire_at int64) error
+
+	// combine already aggregated data into the steps, used by renames
+	Merge(key string, fields map[int]AggregateHashData, expire_at int64) error
+
+	// merge src into dst and delete src in one go, false if src didn't exist
+	Move(src, dst string) (bool, error)
+
+	// unix time a key expires at, 0 if it doesn't exist or never expires
+	ExpireAt(key string) (int64, error)
+
+	Delete(key string) error
+	DeleteFields(key string, fields []int) error
+
+	// add member to the set at key unless it already has limit members, the set
+	// expires like a period hash. true if member is in the set afterwards
+	AddLimited(key, member string, limit int, expire_at int64) (bool, error)
+
+	// every key matching a redis style glob pattern
+	Scan(match string, fn func(key string) error) error
+
+	// plain values for bookkeeping like the registry and rollup checkpoints
+	// Get returns nil when the key doesn't exist
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte) error
+}
+
+type AggregateWrite struct {
+	Key      string
+	Field    int
+	Value    float64
+	ExpireAt int64 // only used if the key is created
+}
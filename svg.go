@@ -0,0 +1,274 @@
+package tophat
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type SVGOptions struct {
+	Width  int
+	Height int
+	Title  string
+	Bar    bool // bars instead of lines
+}
+
+// colours cycled through for each graph
+var svg_palette = []string{
+	"#4e79a7", "#f28e2b", "#e15759", "#76b7b2", "#59a14f",
+	"#edc948", "#b07aa1", "#ff9da7", "#9c755f", "#bab0ac",
+}
+
+// room around the plot for the axis labels and legend
+const (
+	svg_pad_left   = 60
+	svg_pad_right  = 20
+	svg_pad_top    = 30
+	svg_pad_bottom = 40
+	svg_legend_row = 16
+	svg_char_width = 7
+)
+
+func RenderSVG(w io.Writer, graphs []*MetricGraph, step *Timestep, opts SVGOptions) error {
+	// draw a chart of every graph sharing one set of axes, with a legend built from the tags
+	if opts.Width <= 0 {
+		opts.Width = 640
+	}
+	if opts.Height <= 0 {
+		opts.Height = 240
+	}
+	if opts.Width <= svg_pad_left+svg_pad_right || opts.Height <= svg_pad_top+svg_pad_bottom {
+		return errors.New("SVG needs a width over " + strconv.Itoa(svg_pad_left+svg_pad_right) +
+			" and a height over " + strconv.Itoa(svg_pad_top+svg_pad_bottom) + " to fit the axes.")
+	}
+	if step == nil {
+		return errors.New("SVG needs the graphs' timestep to label steps.")
+	}
+
+	// every distinct timestamp across the graphs, for the x axis and bar slots
+	seen := map[float64]bool{}
+	stamps := []float64{}
+	min, max := 0.0, 0.0
+	for _, g := range graphs {
+		for _, v := range g.Values {
+			if !seen[v[0]] {
+				seen[v[0]] = true
+				stamps = append(stamps, v[0])
+			}
+			if math.IsNaN(v[1]) {
+				continue
+			}
+			if v[1] < min {
+				min = v[1]
+			}
+			if v[1] > max {
+				max = v[1]
+			}
+		}
+	}
+	sort.Float64s(stamps)
+	if max == min {
+		max = min + 1
+	}
+
+	legend_height := len(graphs) * svg_legend_row
+	plot_x := float64(svg_pad_left)
+	plot_y := float64(svg_pad_top)
+	plot_w := float64(opts.Width - svg_pad_left - svg_pad_right)
+	plot_h := float64(opts.Height - svg_pad_top - svg_pad_bottom)
+	height := opts.Height + legend_height
+
+	y_of := func(v float64) float64 {
+		return plot_y + plot_h - (v-min)/(max-min)*plot_h
+	}
+
+	// bars share a slot per timestamp, lines run edge to edge
+	slot := plot_w
+	if len(stamps) > 0 {
+		slot = plot_w / float64(len(stamps))
+	}
+	x_of := func(i int) float64 {
+		if opts.Bar {
+			return plot_x + slot*float64(i)
+		}
+		if len(stamps) < 2 {
+			return plot_x + plot_w/2
+		}
+		return plot_x + plot_w*float64(i)/float64(len(stamps)-1)
+	}
+	index := make(map[float64]int, len(stamps))
+	for i, ts := range stamps {
+		index[ts] = i
+	}
+
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="11">`+"\n", opts.Width, height, opts.Width, height)
+	fmt.Fprintf(b, `<rect width="%d" height="%d" fill="#ffffff"/>`+"\n", opts.Width, height)
+
+	if opts.Title != "" {
+		fmt.Fprintf(b, `<text x="%d" y="%d" font-size="13" font-weight="bold">%s</text>`+"\n", svg_pad_left, svg_pad_top-12, svg_escape(opts.Title))
+	}
+
+	// horizontal grid lines with value labels
+	for i := 0; i <= 4; i++ {
+		v := min + (max-min)*float64(i)/4
+		y := y_of(v)
+		fmt.Fprintf(b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#e0e0e0"/>`+"\n", plot_x, y, plot_x+plot_w, y)
+		fmt.Fprintf(b, `<text x="%.1f" y="%.1f" text-anchor="end" fill="#555555">%s</text>`+"\n", plot_x-6, y+4, svg_escape(format_chart_value(v)))
+	}
+
+	// axes
+	fmt.Fprintf(b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#555555"/>`+"\n", plot_x, plot_y, plot_x, plot_y+plot_h)
+	fmt.Fprintf(b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#555555"/>`+"\n", plot_x, plot_y+plot_h, plot_x+plot_w, plot_y+plot_h)
+
+	// a handful of timestamp labels along the bottom
+	if len(stamps) > 0 {
+		ticks := 5
+		if len(stamps) < ticks {
+			ticks = len(stamps)
+		}
+		for t := 0; t < ticks; t++ {
+			i := 0
+			if ticks > 1 {
+				i = t * (len(stamps) - 1) / (ticks - 1)
+			}
+			x := x_of(i)
+			if opts.Bar {
+				x += slot / 2
+			}
+			label := step.FormatStep(int64(stamps[i]))
+			fmt.Fprintf(b, `<text x="%.1f" y="%.1f" text-anchor="middle" fill="#555555">%s</text>`+"\n", x, plot_y+plot_h+16, svg_escape(label))
+		}
+	}
+
+	// the series themselves
+	bar_w := slot * 0.8
+	if len(graphs) > 0 {
+		bar_w /= float64(len(graphs))
+	}
+	for gi, g := range graphs {
+		colour := svg_palette[gi%len(svg_palette)]
+
+		if opts.Bar {
+			for _, v := range g.Values {
+				if math.IsNaN(v[1]) {
+					continue
+				}
+				x := x_of(index[v[0]]) + slot*0.1 + bar_w*float64(gi)
+				top, bottom := y_of(v[1]), y_of(0)
+				if top > bottom {
+					top, bottom = bottom, top
+				}
+				fmt.Fprintf(b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"/>`+"\n", x, top, bar_w, bottom-top, colour)
+			}
+			continue
+		}
+
+		// NaN gaps break the line into pieces
+		for _, line := range svg_lines(g.Values) {
+			points := make([]string, 0, len(line))
+			for _, v := range line {
+				points = append(points, fmt.Sprintf("%.1f,%.1f", x_of(index[v[0]]), y_of(v[1])))
+			}
+			fmt.Fprintf(b, `<polyline points="%s" fill="none" stroke="%s" stroke-width="1.5"/>`+"\n", strings.Join(points, " "), colour)
+		}
+	}
+
+	// legend under the timestamps
+	for gi, g := range graphs {
+		y := float64(opts.Height + gi*svg_legend_row)
+		colour := svg_palette[gi%len(svg_palette)]
+		fmt.Fprintf(b, `<rect x="%.1f" y="%.1f" width="10" height="10" fill="%s"/>`+"\n", plot_x, y-9, colour)
+		fmt.Fprintf(b, `<text x="%.1f" y="%.1f">%s</text>`+"\n", plot_x+16, y, svg_escape(g.Label()))
+	}
+
+	b.WriteString("</svg>\n")
+
+	_, err := b.WriteTo(w)
+	return err
+}
+
+func RenderSVGBadge(w io.Writer, graph *MetricGraph, label string) error {
+	// a small shields style badge: label, sparkline and the latest value
+	const height = 20
+	const spark_w = 60
+
+	value := "n/a"
+	spark := graph.Spark()
+	for i := len(spark) - 1; i >= 0; i-- {
+		if !math.IsNaN(spark[i]) {
+			value = format_chart_value(spark[i])
+			break
+		}
+	}
+
+	label_w := len(label)*svg_char_width + 10
+	value_w := len(value)*svg_char_width + 10
+	width := label_w + spark_w + value_w
+
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="11">`+"\n", width, height, width, height)
+	fmt.Fprintf(b, `<rect width="%d" height="%d" rx="3" fill="#555555"/>`+"\n", width, height)
+	fmt.Fprintf(b, `<rect x="%d" width="%d" height="%d" fill="#4e79a7"/>`+"\n", label_w, spark_w+value_w, height)
+	fmt.Fprintf(b, `<text x="%d" y="14" fill="#ffffff">%s</text>`+"\n", 5, svg_escape(label))
+
+	if len(spark) > 0 {
+		min, max := spark_range(spark)
+		if max == min {
+			max = min + 1
+		}
+		points := make([]string, 0, len(spark))
+		for i, v := range spark {
+			// a gap ends the line so far
+			if math.IsNaN(v) {
+				if len(points) > 0 {
+					fmt.Fprintf(b, `<polyline points="%s" fill="none" stroke="#ffffff" stroke-width="1"/>`+"\n", strings.Join(points, " "))
+				}
+				points = points[:0]
+				continue
+			}
+			x := float64(label_w) + 2
+			if len(spark) > 1 {
+				x += float64(spark_w-4) * float64(i) / float64(len(spark)-1)
+			}
+			y := float64(height-4) - (v-min)/(max-min)*float64(height-8)
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+		}
+		if len(points) > 0 {
+			fmt.Fprintf(b, `<polyline points="%s" fill="none" stroke="#ffffff" stroke-width="1"/>`+"\n", strings.Join(points, " "))
+		}
+	}
+
+	fmt.Fprintf(b, `<text x="%d" y="14" fill="#ffffff">%s</text>`+"\n", label_w+spark_w+5, svg_escape(value))
+	b.WriteString("</svg>\n")
+
+	_, err := b.WriteTo(w)
+	return err
+}
+
+func svg_lines(values [][2]float64) [][][2]float64 {
+	// the runs of values between NaN gaps
+	lines := [][][2]float64{}
+	start := 0
+	for i := 0; i <= len(values); i++ {
+		if i == len(values) || math.IsNaN(values[i][1]) {
+			if i > start {
+				lines = append(lines, values[start:i])
+			}
+			start = i + 1
+		}
+	}
+	return lines
+}
+
+func svg_escape(s string) string {
+	b := &bytes.Buffer{}
+	xml.EscapeText(b, []byte(s))
+	return b.String()
+}
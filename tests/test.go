@@ -3,6 +3,7 @@ package main
 import (
 	crand "crypto/rand"
 	"encoding/base64"
+	"flag"
 	"fmt"
 	"math/rand"
 	"strings"
@@ -13,6 +14,8 @@ import (
 )
 
 func main() {
+	memory := flag.Bool("memory", false, "use in-memory storage instead of redis on localhost:6379")
+	flag.Parse()
 
 	t := 10 * time.Second
 	red := &redis.Pool{
@@ -28,7 +31,13 @@ func main() {
 		},
 	}
 
-	th, err := tophat.NewClient(red)
+	var th *tophat.Client
+	var err error
+	if *memory {
+		th, err = tophat.NewMemoryClient(nil)
+	} else {
+		th, err = tophat.NewClient(red)
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -1,6 +1,7 @@
 package tophat
 
 import (
+	"errors"
 	"sort"
 	"time"
 )
@@ -13,8 +14,70 @@ const (
 	Day
 	Month
 	Year
+	Week // added after Year so existing values keep their numbers
 )
 
+var time_names = map[Time]string{
+	Minute: "minute",
+	Hour:   "hour",
+	Day:    "day",
+	Month:  "month",
+	Year:   "year",
+	Week:   "week",
+}
+
+// shortest to longest, Week was added after Year
+var time_order = map[Time]int{
+	Minute: 0,
+	Hour:   1,
+	Day:    2,
+	Week:   3,
+	Month:  4,
+	Year:   5,
+}
+
+func (t Time) String() string {
+	if name, exists := time_names[t]; exists {
+		return name
+	}
+	return "unknown"
+}
+
+func ParseTime(name string) (Time, error) {
+	for t, n := range time_names {
+		if n == name {
+			return t, nil
+		}
+	}
+	return 0, errors.New("Unknown period: " + name)
+}
+
+// the day Week periods start on, counted from Monday so the zero value
+// gives ISO weeks
+type WeekStart int
+
+const (
+	Monday WeekStart = iota
+	Tuesday
+	Wednesday
+	Thursday
+	Friday
+	Saturday
+	Sunday
+)
+
+func WeekStartOn(day time.Weekday) WeekStart {
+	return WeekStart((int(day) + 6) % 7)
+}
+
+func (w WeekStart) Weekday() time.Weekday {
+	return time.Weekday((int(w) + 1) % 7)
+}
+
+func (w WeekStart) String() string {
+	return w.Weekday().String()
+}
+
 // so we can sort int64 slice
 type int64arr []int64
 
@@ -23,11 +86,29 @@ func (a int64arr) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a int64arr) Less(i, j int) bool { return a[i] < a[j] }
 
 type Timestep struct {
-	Name     string
-	Key      string
-	Period   Time
-	Keep     int
-	NumSteps int
+	Name      string
+	Key       string
+	Period    Time
+	Keep      int
+	NumSteps  int
+	Location  *time.Location // periods are cut at this zone's boundaries, nil is UTC
+	WeekStart WeekStart      // first day of Week periods, the zero value is Monday for ISO weeks
+
+	// optional fixed width for steps instead of the period's natural unit,
+	// e.g. 5 minutes within a day, whole days are counted on the calendar
+	StepWidth time.Duration
+
+	// optional custom periods such as fiscal years, Period then only picks labels
+	// and StepWidth is ignored
+	Calendar Calendar
+}
+
+// the zone periods are cut in, UTC when Location isn't set
+func (t *Timestep) Loc() *time.Location {
+	if t.Location == nil {
+		return time.UTC
+	}
+	return t.Location
 }
 
 func (t *Timestep) StartOfPeriod(ts time.Time) int64 {
@@ -39,173 +120,239 @@ func (t *Timestep) StartOfPreviousPeriod(ts time.Time) int64 {
 }
 
 func (t *Timestep) start_of_period(ts time.Time, previous bool) int64 {
-	// get a unix timestamp for the start of hour / day / month
-	now := ts.UTC()
+	// get a unix timestamp for the start of hour / day / month in the timestep's location
+	// minutes and hours are stepped back in absolute time, so an hour repeated by a dst
+	// change is still two separate periods
+	loc := t.Loc()
+	now := ts.In(loc)
+
+	if t.Calendar != nil {
+		start := t.Calendar.StartOfPeriod(now)
+		if previous {
+			return t.Calendar.PreviousPeriod(start).Unix()
+		}
+		return start.Unix()
+	}
 
 	switch t.Period {
 	case Minute:
+		start := now.Add(-time.Duration(now.Second())*time.Second - time.Duration(now.Nanosecond()))
 		if previous {
-			return time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute()-1, 0, 0, time.UTC).Unix()
+			return start.Add(-time.Minute).Unix()
 		}
-		return time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), 0, 0, time.UTC).Unix()
+		return start.Unix()
 
 	case Hour:
+		start := now.Add(-time.Duration(now.Minute())*time.Minute - time.Duration(now.Second())*time.Second - time.Duration(now.Nanosecond()))
 		if previous {
-			return time.Date(now.Year(), now.Month(), now.Day(), now.Hour()-1, 0, 0, 0, time.UTC).Unix()
+			return start.Add(-time.Hour).Unix()
 		}
-		return time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, time.UTC).Unix()
+		return start.Unix()
 
 	case Day:
 		if previous {
-			return time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, time.UTC).Unix()
+			return time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, loc).Unix()
 		}
-		return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).Unix()
+		return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc).Unix()
+
+	case Week:
+		// go back to the most recent week start day
+		back := (int(now.Weekday()) - int(t.WeekStart.Weekday()) + 7) % 7
+		if previous {
+			back += 7
+		}
+		return time.Date(now.Year(), now.Month(), now.Day()-back, 0, 0, 0, 0, loc).Unix()
 
 	case Month:
 		// remember days start at 1 not 0
 		if previous {
-			return time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.UTC).Unix()
+			return time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, loc).Unix()
 		}
-		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).Unix()
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc).Unix()
 
 	case Year:
 		// remember months start at 1 not 0
 		if previous {
-			return time.Date(now.Year()-1, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+			return time.Date(now.Year()-1, 1, 1, 0, 0, 0, 0, loc).Unix()
 		}
-		return time.Date(now.Year(), 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+		return time.Date(now.Year(), 1, 1, 0, 0, 0, 0, loc).Unix()
 	}
 
 	return 0
 }
 
-func (t *Timestep) last_step_of_period(ts time.Time) time.Time {
-	// get a time for the end of hour / day / month
-	// eg 59th minute of hour, 23rd hour of day etc
-	now := ts.UTC()
-
-	switch t.Period {
-	case Minute:
-		return time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), 59, 0, time.UTC)
-
-	case Hour:
-		return time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 59, 0, 0, time.UTC)
+func (t *Timestep) current_step_of_period(ts time.Time) time.Time {
+	// get a time for the step that the time given falls into
+	// eg current top of the hour if the period is a day
+	// rebuilt from the period start and step so it always matches the hash keys
+	return time.Unix(t.remake_timestamp(t.StartOfPeriod(ts), t.PeriodStep(ts)), 0).In(t.Loc())
+}
 
-	case Day:
-		return time.Date(now.Year(), now.Month(), now.Day(), 23, 0, 0, 0, time.UTC)
+func (t *Timestep) previous_step_of_period(ts time.Time) time.Time {
+	// get a time for the step before the one ts falls into, which may be in the previous period
+	// no step is shorter than a second so backing off one lands in the previous step
+	return t.current_step_of_period(t.current_step_of_period(ts).Add(-time.Second))
+}
 
-	case Month:
-		// remember days start at 1 not 0
-		// 0 means go backwards one
-		return time.Date(now.Year(), now.Month()+1, 0, 0, 0, 0, 0, time.UTC)
+func (t *Timestep) PeriodStep(ts time.Time) int {
+	// if our period is Hour, the step is the minute of the hour
+	// minutes and hours count the time since the start of the period, so a day
+	// with a dst change has 23 or 25 hourly steps rather than a missing or shared one
+	now := ts.In(t.Loc())
 
-	case Year:
-		// remember months start at 1 not 0
-		// 0 means go backwards one
-		return time.Date(now.Year(), 0, 1, 0, 0, 0, 0, time.UTC)
+	if t.Calendar != nil {
+		return t.Calendar.PeriodStep(now)
+	}
+	if t.StepWidth > 0 {
+		return t.width_step(now)
 	}
-
-	return time.Unix(0, 0)
-}
-
-func (t *Timestep) current_step_of_period(ts time.Time) time.Time {
-	// get a time for the step that the time given falls into
-	// eg current top of the hour if the period is a day
-	now := ts.UTC()
 
 	switch t.Period {
 	case Minute:
-		return time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second(), 0, time.UTC)
+		return now.Second()
 
 	case Hour:
-		return time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), 0, 0, time.UTC)
+		return int(now.Sub(time.Unix(t.StartOfPeriod(now), 0)) / time.Minute)
 
 	case Day:
-		return time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, time.UTC)
+		return int(now.Sub(time.Unix(t.StartOfPeriod(now), 0)) / time.Hour)
+
+	case Week:
+		// days since the week start, from 0
+		return calendar_days(time.Unix(t.StartOfPeriod(now), 0).In(t.Loc()), now)
 
 	case Month:
-		// remember days start at 1 not 0
-		// 0 means go backwards one
-		return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		return now.Day()
 
 	case Year:
-		// remember months start at 1 not 0
-		// 0 means go backwards one
-		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return int(now.Month())
 	}
 
-	return time.Unix(0, 0)
+	return -1
 }
 
-func (t *Timestep) previous_step_of_period(ts time.Time) time.Time {
-	// get a unix timestamp for the previous step based on what period we are using
-	// go backwards an increment from ts
-	now := ts.UTC()
-
-	switch t.Period {
-	case Minute:
-		return time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second()-1, 0, time.UTC)
+func (t *Timestep) high_resolution() bool {
+	// steps of under a minute, written far more often than the rest
+	if t.Calendar != nil {
+		return false
+	}
+	if t.StepWidth > 0 {
+		return t.StepWidth < time.Minute
+	}
+	return t.Period == Minute
+}
 
-	case Hour:
-		return time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute()-1, 0, 0, time.UTC)
+func (t *Timestep) width_step(now time.Time) int {
+	// steps of a fixed width count from 0 at the start of the period
+	start := time.Unix(t.StartOfPeriod(now), 0).In(t.Loc())
 
-	case Day:
-		return time.Date(now.Year(), now.Month(), now.Day(), now.Hour()-1, 0, 0, 0, time.UTC)
+	if days := t.width_days(); days > 0 {
+		return calendar_days(start, now) / days
+	}
 
-	case Month:
-		// remember days start at 1 not 0
-		// 0 means go backwards one
-		return time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, time.UTC)
+	return int(now.Sub(start) / t.StepWidth)
+}
 
-	case Year:
-		// remember months start at 1 not 0
-		// 0 means go backwards one
-		return time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.UTC)
+func (t *Timestep) width_days() int {
+	// widths of whole days step on the calendar so a dst change doesn't shift them
+	if t.StepWidth%(24*time.Hour) != 0 {
+		return 0
 	}
+	return int(t.StepWidth / (24 * time.Hour))
+}
 
-	return time.Unix(0, 0)
+func calendar_days(from, to time.Time) int {
+	// whole calendar days between two local dates
+	a := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	b := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC)
+	return int(b.Sub(a) / (24 * time.Hour))
 }
 
-func (t *Timestep) PeriodStep(ts time.Time) int {
-	// if our period is Hour, the step is the minute of the hour
+func (t *Timestep) remake_timestamp(start int64, offset int) int64 {
+	// we want to add the amount of time for the period under the given
+	// so we a remaking an offset timestamp for a day graph, we add offset * seconds_in_hours\
+	// being careful that day and month offsets do not start at 0
+	end := time.Unix(start, 0).In(t.Loc())
+
+	if t.Calendar != nil {
+		return t.Calendar.StepTime(end, offset).Unix()
+	}
+	if t.StepWidth > 0 {
+		if days := t.width_days(); days > 0 {
+			return end.AddDate(0, 0, offset*days).Unix()
+		}
+		return end.Add(time.Duration(offset) * t.StepWidth).Unix()
+	}
+
 	switch t.Period {
 	case Minute:
-		return ts.UTC().Second()
-
+		end = end.Add(time.Duration(offset) * time.Second)
 	case Hour:
-		return ts.UTC().Minute()
-
+		end = end.Add(time.Duration(offset) * time.Minute)
 	case Day:
-		return ts.UTC().Hour()
-
+		end = end.Add(time.Duration(offset) * time.Hour)
+	case Week:
+		end = end.AddDate(0, 0, offset)
 	case Month:
-		return ts.UTC().Day()
-
+		end = end.AddDate(0, 0, offset-1)
 	case Year:
-		return int(ts.UTC().Month())
+		end = end.AddDate(0, offset-1, 0)
 	}
 
-	return -1
+	return end.Unix()
+}
+
+func (t *Timestep) step_seconds(ts int64) int64 {
+	// how long the step starting at ts lasts, the last step of a period ends with it
+	at := time.Unix(ts, 0)
+	start := t.StartOfPeriod(at)
+	next := t.remake_timestamp(start, t.PeriodStep(at)+1)
+	if end := t.end_of_period(start); next > end {
+		next = end
+	}
+	return next - ts
 }
 
 func (t *Timestep) PeriodExpireAt(ts time.Time) int64 {
 	// return a unix timestamp for time of expiry to set in redis
 	// we use a value 2 * period because we need to query 2 keys to get the last period from now()
+	return t.periods_after(t.StartOfPeriod(ts), t.Keep)
+}
+
+func (t *Timestep) end_of_period(start int64) int64 {
+	// the start of the next period is the end of this one
+	return t.periods_after(start, 1)
+}
+
+func (t *Timestep) periods_after(period_start int64, n int) int64 {
+	// a unix timestamp n periods on from the start of a period
+	start := time.Unix(period_start, 0).In(t.Loc())
+
+	if t.Calendar != nil {
+		for x := 0; x < n; x++ {
+			start = t.Calendar.NextPeriod(start)
+		}
+		return start.Unix()
+	}
+
 	switch t.Period {
 	case Minute:
-		return time.Unix(t.StartOfPeriod(ts), 0).Add(time.Duration(t.Keep) * time.Minute).Unix()
+		return start.Add(time.Duration(n) * time.Minute).Unix()
 
 	case Hour:
-		return time.Unix(t.StartOfPeriod(ts), 0).Add(time.Duration(t.Keep) * time.Hour).Unix()
+		return start.Add(time.Duration(n) * time.Hour).Unix()
 
 	case Day:
-		return time.Unix(t.StartOfPeriod(ts), 0).AddDate(0, 0, t.Keep).Unix()
+		return start.AddDate(0, 0, n).Unix()
+
+	case Week:
+		return start.AddDate(0, 0, 7*n).Unix()
 
 	case Month:
-		return time.Unix(t.StartOfPeriod(ts), 0).AddDate(0, t.Keep, 0).Unix()
+		return start.AddDate(0, n, 0).Unix()
 
 	case Year:
-		return time.Unix(t.StartOfPeriod(ts), 0).AddDate(t.Keep, 0, 0).Unix()
+		return start.AddDate(n, 0, 0).Unix()
 	}
 
 	return 1
@@ -234,7 +381,44 @@ func (t *Timestep) PeriodStepList(ts time.Time, override int) []int64 {
 	return list
 }
 
+func (t *Timestep) FormatStep(ts int64) string {
+	// a timestamp label that suits the size of the steps
+	when := time.Unix(ts, 0).In(t.Loc())
+
+	// steps narrower than a day need the time whatever the period
+	if t.Calendar == nil && t.StepWidth > 0 && t.width_days() == 0 && time_order[t.Period] > time_order[Hour] {
+		return when.Format("Jan 2 15:04")
+	}
+
+	switch t.Period {
+	case Minute:
+		return when.Format("15:04:05")
+	case Hour:
+		return when.Format("15:04")
+	case Day:
+		return when.Format("Jan 2 15:04")
+	case Week:
+		return when.Format("Mon Jan 2")
+	case Month:
+		return when.Format("Jan 2")
+	case Year:
+		return when.Format("Jan 2006")
+	}
+
+	return when.Format(time.RFC3339)
+}
+
 // define some default normal steps
+// minutely data with second steps, for incidents and load tests
+// metrics have to opt in with HighResolution as every write costs an extra step
+var TimestepMinute = &Timestep{
+	Name:     "minute",
+	Key:      "s",
+	Period:   Minute,
+	Keep:     2,
+	NumSteps: 60,
+}
+
 // hourly data with minute steps
 var TimestepHour = &Timestep{
 	Name:     "hour",
@@ -253,6 +437,16 @@ var TimestepDay = &Timestep{
 	NumSteps: 24,
 }
 
+// daily for an iso week, starting monday
+var TimestepWeek = &Timestep{
+	Name:      "week",
+	Key:       "w",
+	Period:    Week,
+	Keep:      2,
+	NumSteps:  7,
+	WeekStart: Monday,
+}
+
 // daily for a month
 var TimestepMonth = &Timestep{
 	Name:     "month",
@@ -271,6 +465,18 @@ var TimestepYear = &Timestep{
 	NumSteps: 12,
 }
 
+// every timestep a client starts with
+var BuiltinTimesteps = []*Timestep{
+	TimestepMinute,
+	TimestepHour,
+	TimestepDay,
+	TimestepWeek,
+	TimestepMonth,
+	TimestepYear,
+}
+
+// the usual Steps for a metric, a subset of BuiltinTimesteps. minute is left out
+// as it needs Metric.HighResolution and week as month already covers its days
 var DefaultTimesteps = []*Timestep{
 	TimestepHour,
 	TimestepDay,
@@ -0,0 +1,219 @@
+package tophat
+
+import (
+	"testing"
+	"time"
+)
+
+func load_location(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestLocationDays(t *testing.T) {
+	// days are cut at local midnight and count hours from it, so dst days have 23 or 25 steps
+	sydney := load_location(t, "Australia/Sydney")
+	kolkata := load_location(t, "Asia/Kolkata")
+
+	tests := []struct {
+		loc   *time.Location
+		date  time.Time
+		steps int
+	}{
+		{sydney, time.Date(2024, 4, 7, 0, 0, 0, 0, sydney), 25},
+		{sydney, time.Date(2024, 10, 6, 0, 0, 0, 0, sydney), 23},
+		{sydney, time.Date(2024, 6, 1, 0, 0, 0, 0, sydney), 24},
+		{kolkata, time.Date(2024, 3, 1, 0, 0, 0, 0, kolkata), 24},
+		{nil, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), 24},
+	}
+
+	for _, tt := range tests {
+		step := &Timestep{Name: "day", Key: "d", Period: Day, Keep: 2, NumSteps: 24, Location: tt.loc}
+		name := tt.date.Format("2006-01-02 MST")
+
+		start := step.StartOfPeriod(tt.date.Add(12 * time.Hour))
+		if start != tt.date.Unix() {
+			t.Errorf("%s: period starts at %d, want local midnight %d", name, start, tt.date.Unix())
+		}
+		if prev := step.StartOfPreviousPeriod(tt.date.Add(12 * time.Hour)); prev != tt.date.AddDate(0, 0, -1).Unix() {
+			t.Errorf("%s: previous period starts at %d, want %d", name, prev, tt.date.AddDate(0, 0, -1).Unix())
+		}
+
+		end := step.end_of_period(start)
+		if steps := int(end-start) / 3600; steps != tt.steps {
+			t.Errorf("%s: %d hourly steps, want %d", name, steps, tt.steps)
+		}
+		for i := 0; i < tt.steps; i++ {
+			ts := start + int64(i)*3600
+			if got := step.PeriodStep(time.Unix(ts+1800, 0)); got != i {
+				t.Errorf("%s: step of hour %d is %d", name, i, got)
+			}
+			if got := step.remake_timestamp(start, i); got != ts {
+				t.Errorf("%s: step %d starts at %d, want %d", name, i, got, ts)
+			}
+		}
+
+		// a graph of the whole day has every step once
+		list := step.PeriodStepList(time.Unix(end-1, 0), tt.steps)
+		if len(list) != tt.steps || list[0] != start || list[len(list)-1] != end-3600 {
+			t.Errorf("%s: step list %v", name, list)
+		}
+	}
+}
+
+func TestLocationHours(t *testing.T) {
+	// hours follow the zone's offset, half hours in kolkata, and a repeated dst hour is two periods
+	sydney := load_location(t, "Australia/Sydney")
+	kolkata := load_location(t, "Asia/Kolkata")
+
+	tests := []struct {
+		loc   *time.Location
+		ts    time.Time
+		start time.Time
+		step  int
+	}{
+		{kolkata, time.Date(2024, 3, 1, 10, 45, 0, 0, time.UTC), time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC), 15},
+		{kolkata, time.Date(2024, 3, 1, 10, 15, 0, 0, time.UTC), time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC), 45},
+		{nil, time.Date(2024, 3, 1, 10, 45, 0, 0, time.UTC), time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC), 45},
+
+		// 02:30 twice on the 7th of april, first in AEDT then AEST
+		{sydney, time.Date(2024, 4, 6, 15, 30, 0, 0, time.UTC), time.Date(2024, 4, 6, 15, 0, 0, 0, time.UTC), 30},
+		{sydney, time.Date(2024, 4, 6, 16, 30, 0, 0, time.UTC), time.Date(2024, 4, 6, 16, 0, 0, 0, time.UTC), 30},
+	}
+
+	for _, tt := range tests {
+		step := &Timestep{Name: "hour", Key: "h", Period: Hour, Keep: 2, NumSteps: 60, Location: tt.loc}
+		if got := step.StartOfPeriod(tt.ts); got != tt.start.Unix() {
+			t.Errorf("%s in %s: period starts at %s, want %s", tt.ts, step.Loc(), time.Unix(got, 0).UTC(), tt.start)
+		}
+		if got := step.PeriodStep(tt.ts); got != tt.step {
+			t.Errorf("%s in %s: step %d, want %d", tt.ts, step.Loc(), got, tt.step)
+		}
+	}
+
+	// kolkata days start at 18:30 utc the day before
+	day := &Timestep{Name: "day", Key: "d", Period: Day, Keep: 2, NumSteps: 24, Location: kolkata}
+	if got, want := day.StartOfPeriod(time.Date(2024, 3, 1, 20, 0, 0, 0, time.UTC)), time.Date(2024, 3, 1, 18, 30, 0, 0, time.UTC).Unix(); got != want {
+		t.Errorf("kolkata day starts at %s, want %s", time.Unix(got, 0).UTC(), time.Unix(want, 0).UTC())
+	}
+}
+
+func TestStepWidth(t *testing.T) {
+	// widths count from the start of the period, a width that doesn't divide
+	// the period leaves a shorter last step
+	sydney := load_location(t, "Australia/Sydney")
+
+	tests := []struct {
+		name    string
+		step    *Timestep
+		ts      time.Time
+		index   int
+		start   time.Time
+		seconds int64
+	}{
+		{"5m in a day", &Timestep{Period: Day, StepWidth: 5 * time.Minute},
+			time.Date(2024, 3, 1, 10, 7, 0, 0, time.UTC), 121, time.Date(2024, 3, 1, 10, 5, 0, 0, time.UTC), 300},
+		{"7m in an hour", &Timestep{Period: Hour, StepWidth: 7 * time.Minute},
+			time.Date(2024, 3, 1, 10, 6, 59, 0, time.UTC), 0, time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC), 420},
+		{"7m remainder", &Timestep{Period: Hour, StepWidth: 7 * time.Minute},
+			time.Date(2024, 3, 1, 10, 58, 0, 0, time.UTC), 8, time.Date(2024, 3, 1, 10, 56, 0, 0, time.UTC), 240},
+		{"2 days in a month", &Timestep{Period: Month, StepWidth: 48 * time.Hour},
+			time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC), 1, time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC), 2 * 86400},
+		{"2 day remainder", &Timestep{Period: Month, StepWidth: 48 * time.Hour},
+			time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC), 15, time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC), 86400},
+
+		// whole days step on the calendar across dst, shorter widths in absolute time
+		{"1 day over dst", &Timestep{Period: Month, StepWidth: 24 * time.Hour, Location: sydney},
+			time.Date(2024, 4, 7, 23, 0, 0, 0, sydney), 6, time.Date(2024, 4, 7, 0, 0, 0, 0, sydney), 25 * 3600},
+		{"30m over dst", &Timestep{Period: Day, StepWidth: 30 * time.Minute, Location: sydney},
+			time.Date(2024, 4, 7, 23, 45, 0, 0, sydney), 49, time.Date(2024, 4, 7, 23, 30, 0, 0, sydney), 1800},
+	}
+
+	for _, tt := range tests {
+		tt.step.Name, tt.step.Key, tt.step.Keep, tt.step.NumSteps = tt.name, "w", 2, 10
+
+		index := tt.step.PeriodStep(tt.ts)
+		if index != tt.index {
+			t.Errorf("%s: step %d, want %d", tt.name, index, tt.index)
+		}
+		start := tt.step.remake_timestamp(tt.step.StartOfPeriod(tt.ts), index)
+		if start != tt.start.Unix() {
+			t.Errorf("%s: step starts at %s, want %s", tt.name, time.Unix(start, 0).In(tt.step.Loc()), tt.start)
+		}
+		if seconds := tt.step.step_seconds(start); seconds != tt.seconds {
+			t.Errorf("%s: step lasts %ds, want %ds", tt.name, seconds, tt.seconds)
+		}
+	}
+}
+
+func TestStepWidthValidation(t *testing.T) {
+	c, err := NewMemoryClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		width time.Duration
+		ok    bool
+	}{
+		{5 * time.Minute, true},
+		{90 * time.Second, true},
+		{0, true},
+		{-time.Minute, false},
+		{1500 * time.Millisecond, false},
+	}
+	for i, tt := range tests {
+		err := c.AddTimestep(&Timestep{Name: "w" + time.Duration(i).String(), Key: "w", Period: Day, Keep: 2, NumSteps: 10, StepWidth: tt.width})
+		if (err == nil) != tt.ok {
+			t.Errorf("width %s: got error %v", tt.width, err)
+		}
+	}
+}
+
+func TestWeekStart(t *testing.T) {
+	// 2024-03-04 is a monday, weeks are kept for 2 periods
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		start    WeekStart
+		ts       time.Time
+		period   time.Time
+		previous time.Time
+	}{
+		// the zero value is an iso week
+		{0, day(6).Add(15 * time.Hour), day(4), day(4).AddDate(0, 0, -7)},
+		{Monday, day(4), day(4), day(4).AddDate(0, 0, -7)},
+		{Monday, day(10).Add(23 * time.Hour), day(4), day(4).AddDate(0, 0, -7)},
+		{Monday, day(11), day(11), day(4)},
+
+		{Sunday, day(6), day(3), day(3).AddDate(0, 0, -7)},
+		{Sunday, day(9).Add(23 * time.Hour), day(3), day(3).AddDate(0, 0, -7)},
+		{Sunday, day(10), day(10), day(3)},
+		{Saturday, day(8), day(2), day(2).AddDate(0, 0, -7)},
+	}
+
+	for _, tt := range tests {
+		step := &Timestep{Name: "w", Key: "w", Period: Week, Keep: 2, NumSteps: 7, WeekStart: tt.start}
+		if got := step.StartOfPeriod(tt.ts); got != tt.period.Unix() {
+			t.Errorf("%s week of %s: starts %s, want %s", tt.start, tt.ts, time.Unix(got, 0).UTC(), tt.period)
+		}
+		if got := step.StartOfPreviousPeriod(tt.ts); got != tt.previous.Unix() {
+			t.Errorf("%s week of %s: previous starts %s, want %s", tt.start, tt.ts, time.Unix(got, 0).UTC(), tt.previous)
+		}
+		if got, want := step.PeriodExpireAt(tt.ts), tt.period.AddDate(0, 0, 14).Unix(); got != want {
+			t.Errorf("%s week of %s: expires %s, want %s", tt.start, tt.ts, time.Unix(got, 0).UTC(), time.Unix(want, 0).UTC())
+		}
+	}
+
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if got := WeekStartOn(d).Weekday(); got != d {
+			t.Errorf("WeekStartOn(%s) is %s", d, got)
+		}
+	}
+	if WeekStartOn(time.Monday) != 0 || WeekStartOn(time.Sunday) != Sunday {
+		t.Errorf("WeekStartOn counts from %s", WeekStart(0))
+	}
+}
@@ -0,0 +1,268 @@
+package tophat
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+// a change made to every value of a graph, in order, after it's fetched.
+// made with the functions below or by name, as query pipes do
+type Transform struct {
+	Name string    `json:"name"`
+	Args []float64 `json:"args,omitempty"`
+}
+
+type transform_fn struct {
+	args  int
+	check func(args []float64) error
+	apply func(values [][2]float64, args []float64, step *Timestep) ([][2]float64, error)
+}
+
+var transforms = map[string]transform_fn{
+	"movavg":     {1, check_whole, transform_movavg},
+	"ewma":       {1, check_alpha, transform_ewma},
+	"rate":       {0, nil, transform_rate},
+	"cumulative": {0, nil, transform_cumulative},
+	"derivative": {0, nil, transform_derivative},
+	"scale":      {1, nil, transform_scale},
+	"offset":     {1, nil, transform_offset},
+	"clamp":      {2, check_range, transform_clamp},
+}
+
+// each value is the mean of it and the values before it, up to n of them
+func MovingAverage(n int) Transform {
+	return Transform{Name: "movavg", Args: []float64{float64(n)}}
+}
+
+// exponential smoothing, alpha between 0 and 1 is how much each value counts over the ones before
+func Smooth(alpha float64) Transform {
+	return Transform{Name: "ewma", Args: []float64{alpha}}
+}
+
+// values per second of the step they're in, e.g. requests per second from hourly counts
+func Rate() Transform {
+	return Transform{Name: "rate"}
+}
+
+// a running total
+func Cumulative() Transform {
+	return Transform{Name: "cumulative"}
+}
+
+// change per second since the previous value, the first value is dropped
+func Derivative() Transform {
+	return Transform{Name: "derivative"}
+}
+
+func Scale(factor float64) Transform {
+	return Transform{Name: "scale", Args: []float64{factor}}
+}
+
+func Offset(amount float64) Transform {
+	return Transform{Name: "offset", Args: []float64{amount}}
+}
+
+// values outside min and max are set to them
+func Clamp(min, max float64) Transform {
+	return Transform{Name: "clamp", Args: []float64{min, max}}
+}
+
+func (tr Transform) check() error {
+	fn, exists := transforms[tr.Name]
+	if !exists {
+		return errors.New("Unknown transform: " + tr.Name)
+	}
+	if len(tr.Args) != fn.args {
+		return errors.New("Transform " + tr.Name + " takes " + strconv.Itoa(fn.args) + " arguments.")
+	}
+	if fn.check != nil {
+		if err := fn.check(tr.Args); err != nil {
+			return errors.New("Transform " + tr.Name + " " + err.Error())
+		}
+	}
+	return nil
+}
+
+func (mg *MetricGraph) Transform(step *Timestep, trs ...Transform) error {
+	// apply the transforms in order, step is the timestep the graph was made with
+	// shifted graphs are transformed the same way and their change worked out again
+	for _, tr := range trs {
+		if err := tr.check(); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	for _, tr := range trs {
+		if mg.Values, err = transform_gaps(mg.Values, tr, step); err != nil {
+			return err
+		}
+		for _, s := range mg.Shifted {
+			if s.Values, err = transform_gaps(s.Values, tr, step); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(trs) > 0 {
+		for _, s := range mg.Shifted {
+			s.Change = percent_change(mg.Values, s.Values)
+		}
+	}
+	return nil
+}
+
+func transform_gaps(values [][2]float64, tr Transform, step *Timestep) ([][2]float64, error) {
+	// transforms only see real values, NaN gaps from NullFill are put back where they were
+	gaps := []float64{}
+	present := make([][2]float64, 0, len(values))
+	for _, v := range values {
+		if math.IsNaN(v[1]) {
+			gaps = append(gaps, v[0])
+		} else {
+			present = append(present, v)
+		}
+	}
+
+	result, err := transforms[tr.Name].apply(present, tr.Args, step)
+	if err != nil || len(gaps) == 0 {
+		return result, err
+	}
+
+	merged := make([][2]float64, 0, len(result)+len(gaps))
+	for len(result) > 0 || len(gaps) > 0 {
+		if len(gaps) == 0 || len(result) > 0 && result[0][0] < gaps[0] {
+			merged = append(merged, result[0])
+			result = result[1:]
+		} else {
+			merged = append(merged, [2]float64{gaps[0], math.NaN()})
+			gaps = gaps[1:]
+		}
+	}
+	return merged, nil
+}
+
+func percent_change(values, before [][2]float64) [][2]float64 {
+	// percentage change at each step both have, where there's something to compare to
+	earlier := make(map[float64]float64, len(before))
+	for _, v := range before {
+		earlier[v[0]] = v[1]
+	}
+
+	change := make([][2]float64, 0, len(values))
+	for _, v := range values {
+		if b, exists := earlier[v[0]]; exists && b != 0 && !math.IsNaN(b) && !math.IsNaN(v[1]) {
+			change = append(change, [2]float64{v[0], (v[1] - b) / b * 100})
+		}
+	}
+	return change
+}
+
+func check_whole(args []float64) error {
+	if args[0] < 1 || args[0] != math.Floor(args[0]) {
+		return errors.New("needs a whole number of at least 1.")
+	}
+	return nil
+}
+
+func check_alpha(args []float64) error {
+	if args[0] <= 0 || args[0] > 1 {
+		return errors.New("needs an alpha above 0 and at most 1.")
+	}
+	return nil
+}
+
+func check_range(args []float64) error {
+	if args[0] > args[1] {
+		return errors.New("needs min no more than max.")
+	}
+	return nil
+}
+
+func transform_movavg(values [][2]float64, args []float64, _ *Timestep) ([][2]float64, error) {
+	n := int(args[0])
+	result := make([][2]float64, len(values))
+	sum := 0.0
+	for i, v := range values {
+		sum += v[1]
+		if i >= n {
+			sum -= values[i-n][1]
+		}
+		count := n
+		if i+1 < n {
+			count = i + 1
+		}
+		result[i] = [2]float64{v[0], sum / float64(count)}
+	}
+	return result, nil
+}
+
+func transform_ewma(values [][2]float64, args []float64, _ *Timestep) ([][2]float64, error) {
+	alpha := args[0]
+	result := make([][2]float64, len(values))
+	for i, v := range values {
+		s := v[1]
+		if i > 0 {
+			s = alpha*v[1] + (1-alpha)*result[i-1][1]
+		}
+		result[i] = [2]float64{v[0], s}
+	}
+	return result, nil
+}
+
+func transform_rate(values [][2]float64, _ []float64, step *Timestep) ([][2]float64, error) {
+	// steps can differ in length, months and days across dst, so each is divided by its own
+	if step == nil {
+		return nil, errors.New("Transform rate needs the graph's timestep.")
+	}
+	result := make([][2]float64, len(values))
+	for i, v := range values {
+		result[i] = [2]float64{v[0], v[1] / float64(step.step_seconds(int64(v[0])))}
+	}
+	return result, nil
+}
+
+func transform_cumulative(values [][2]float64, _ []float64, _ *Timestep) ([][2]float64, error) {
+	result := make([][2]float64, len(values))
+	sum := 0.0
+	for i, v := range values {
+		sum += v[1]
+		result[i] = [2]float64{v[0], sum}
+	}
+	return result, nil
+}
+
+func transform_derivative(values [][2]float64, _ []float64, _ *Timestep) ([][2]float64, error) {
+	// by the time between values rather than per step so missing steps don't inflate it
+	result := make([][2]float64, 0, len(values))
+	for i := 1; i < len(values); i++ {
+		prev, v := values[i-1], values[i]
+		result = append(result, [2]float64{v[0], (v[1] - prev[1]) / (v[0] - prev[0])})
+	}
+	return result, nil
+}
+
+func transform_scale(values [][2]float64, args []float64, _ *Timestep) ([][2]float64, error) {
+	result := make([][2]float64, len(values))
+	for i, v := range values {
+		result[i] = [2]float64{v[0], v[1] * args[0]}
+	}
+	return result, nil
+}
+
+func transform_offset(values [][2]float64, args []float64, _ *Timestep) ([][2]float64, error) {
+	result := make([][2]float64, len(values))
+	for i, v := range values {
+		result[i] = [2]float64{v[0], v[1] + args[0]}
+	}
+	return result, nil
+}
+
+func transform_clamp(values [][2]float64, args []float64, _ *Timestep) ([][2]float64, error) {
+	result := make([][2]float64, len(values))
+	for i, v := range values {
+		result[i] = [2]float64{v[0], math.Min(math.Max(v[1], args[0]), args[1])}
+	}
+	return result, nil
+}